@@ -0,0 +1,143 @@
+package maquina
+
+import "context"
+
+// Activity is a labelled function run in its own goroutine while a state is
+// active. See [State.Do].
+type Activity[T input] struct {
+	label string
+	fn    func(ctx context.Context, input T) error
+}
+
+// String returns the label with which a was created.
+func (a Activity[T]) String() string { return a.label }
+
+// NewActivity instantiates a new Activity with a label and a function to run
+// while a state is active. fn should return once ctx is cancelled.
+func NewActivity[T input](label string, fn func(ctx context.Context, input T) error) Activity[T] {
+	if label == "" {
+		panic("empty activity label")
+	} else if fn == nil {
+		panic("nil activity function")
+	}
+	return Activity[T]{label: label, fn: fn}
+}
+
+// stateActivity is an activity declaration of a state.
+type stateActivity[T input] struct {
+	activity Activity[T]
+	onError  Trigger
+}
+
+// activityKey is the context key of the id of the activity a context was passed to.
+type activityKey struct{}
+
+// runningActivity is an activity launched on entering state.
+type runningActivity[T input] struct {
+	id       uint64
+	state    *State[T]
+	activity stateActivity[T]
+	// input is the input of the transition that entered state.
+	input  T
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Do registers an activity on receiver s which is launched in its own goroutine
+// each time s is entered, after the entry callbacks of s, with the input of the
+// transition that entered s. The activity's context is derived from the state
+// context of s and is cancelled when s is exited. Exiting s waits for the activity
+// to return before the exit callbacks of s are run, unless the state machine is
+// wrapped by a SyncStateMachine, in which case the call that exited s waits for
+// the activity once the lock is released so that the activity may call methods
+// of the SyncStateMachine.
+//
+// An activity firing a trigger that exits its own state must fire it with the
+// context it received, or a context derived from it, so that exiting the state
+// does not wait for the activity itself to return:
+//
+//	work.Do(NewActivity("job", func(ctx context.Context, in int) error {
+//		// Do the work, then leave.
+//		return ssm.Fire(ctx, "finished", in)
+//	}), "")
+//
+// If onError is not empty and the activity returns an error while s is active,
+// onError is fired on the state machine with the input the activity received.
+// Like timers, activities fire triggers from their own goroutine, see [State.After].
+// Errors of activities returning after s was exited are discarded. As with timers,
+// a state machine cannot be created in a state with activities. See [NewStateMachine].
+func (s *State[T]) Do(activity Activity[T], onError Trigger) {
+	if activity.fn == nil {
+		panic("nil activity")
+	}
+	if onError != "" {
+		onError.mustNotBeReserved()
+	}
+	s.activities = append(s.activities, stateActivity[T]{activity: activity, onError: onError})
+}
+
+// startActivities launches the activities registered on s.
+func (sm *StateMachine[T]) startActivities(s *State[T], input T) {
+	for _, sa := range s.activities {
+		sm.launchActivity(s, sa, input)
+	}
+}
+
+// launchActivity launches activity sa of the active state s with input.
+func (sm *StateMachine[T]) launchActivity(s *State[T], sa stateActivity[T], input T) {
+	sm.activitySeq++
+	id, onError := sm.activitySeq, sa.onError
+	ctx, cancel := context.WithCancel(sm.StateContext(s))
+	ctx = context.WithValue(ctx, activityKey{}, id)
+	done := make(chan struct{})
+	sm.activities = append(sm.activities, runningActivity[T]{id: id, state: s, activity: sa, input: input, cancel: cancel, done: done})
+	go func(fn func(context.Context, T) error) {
+		err := fn(ctx, input)
+		// Signal completion before dispatching so that exiting s does not
+		// wait on an activity waiting for the state machine.
+		close(done)
+		if err != nil && onError != "" && ctx.Err() == nil {
+			sm.runAsync(func() { sm.activityFailed(id, onError, input) })
+		}
+	}(sa.activity.fn)
+}
+
+// stopActivities cancels the activities launched on entering s and waits for them
+// to return, or leaves waiting to the SyncStateMachine wrapping sm. The activity
+// whose context ctx derives from, if any, is not waited for since it is the caller.
+// Activities stopped during a transition are recorded in the journal so that they
+// are relaunched if the transition is rolled back.
+func (sm *StateMachine[T]) stopActivities(ctx context.Context, s *State[T]) {
+	self, _ := ctx.Value(activityKey{}).(uint64)
+	kept := sm.activities[:0]
+	for _, ra := range sm.activities {
+		if !statesEqual(ra.state, s) {
+			kept = append(kept, ra)
+			continue
+		}
+		ra.cancel()
+		if sm.journal.active {
+			sm.journal.activities = append(sm.journal.activities, ra)
+		}
+		if ra.id == self {
+			continue
+		} else if sm.waitStopped {
+			sm.stopped = append(sm.stopped, ra.done)
+		} else {
+			<-ra.done
+		}
+	}
+	sm.activities = kept
+}
+
+// activityFailed fires trigger t if the activity with the given id was not stopped.
+func (sm *StateMachine[T]) activityFailed(id uint64, t Trigger, input T) {
+	for i, ra := range sm.activities {
+		if ra.id == id {
+			sm.activities = append(sm.activities[:i], sm.activities[i+1:]...)
+			ra.cancel()
+			sm.Fire(context.Background(), t, input)
+			return
+		}
+	}
+}
@@ -15,11 +15,29 @@ import (
 //     labelled with the trigger.
 //   - Transitions with guards are shown as dashed arrows and their guards are
 //     listed below the transition trigger label surrounded by square brackets.
+//   - Final states are shown with a double border.
+//   - Choice pseudo-states are shown as diamonds with a dashed arrow per branch labelled
+//     with the branch's guards. The else branch is labelled "[else]".
+//   - Automatic transitions are shown as thick arrows labelled "(automatic)".
+//   - Transitions triggered by a timer of the source state list the timer's
+//     duration below the trigger as "after(duration)".
+//   - Transition effects are listed last in the transition label preceded by a slash.
+//   - Dynamic transitions are shown as one arrow per possible destination with
+//     the destination selector label below the trigger surrounded by parentheses.
 //   - States with only exiting transitions are shown in blue ("sources" in graph theory).
 //     Due to internal state representation only the state machine's start state can be a source.
 //     These states once left cannot be re-entered.
 //   - States with only entering transitions are shown in red ("sinks" in graph theory).
 //     These states once reached cannot be exited.
+//   - Transitions a substate inherits from its superstates are shown as gray arrows
+//     leaving the substate.
+//   - Superstates are shown as clusters containing their substates. The initial
+//     substate of a superstate is pointed to by an arrow leaving a dot.
+//   - Orthogonal regions are shown as dashed clusters within their superstate's cluster.
+//   - History pseudo-states are shown as circles labelled "H" or "H*" within their
+//     superstate's cluster.
+//   - Internal transitions are listed inside the box of the state they are registered on
+//     below the state's label as "trigger [guard] / action".
 func WriteDOT[T input](w io.Writer, sm *StateMachine[T]) (n int, err error) {
 	ngot, err := w.Write([]byte("digraph {\n  rankdir=LR;\n  node [shape = box];\n  graph [ dpi = 300 ];\n"))
 	n += ngot
@@ -27,7 +45,7 @@ func WriteDOT[T input](w io.Writer, sm *StateMachine[T]) (n int, err error) {
 		return n, err
 	}
 	isSource := true
-	superStates := make(map[string][]*State[T])
+	var clusters clusters[T]
 	err = WalkStates(sm.actual, func(s *State[T]) error {
 		if s.isSink() {
 			ngot, err = fmt.Fprintf(w, "  %q [ color = red ]\n", s.label)
@@ -36,12 +54,40 @@ func WriteDOT[T input](w io.Writer, sm *StateMachine[T]) (n int, err error) {
 				return err
 			}
 		}
-		if s.parent != nil {
-			superStates[s.parent.label] = append(superStates[s.parent.label], s)
+		if label := internalLabel(s, "\n"); label != "" {
+			ngot, err = fmt.Fprintf(w, "  %q [ label = %q ]\n", s.label, s.label+label)
+			n += ngot
+			if err != nil {
+				return err
+			}
+		}
+		clusters.add(s)
+		if s.final {
+			ngot, err = fmt.Fprintf(w, "  %q [ peripheries = 2 ]\n", s.label)
+			n += ngot
+			if err != nil {
+				return err
+			}
 		}
-		for i := 0; i < len(s.transitions); i++ {
-			tr := s.transitions[i]
-			ngot, err = writeDOTentry(w, tr)
+		if s.choice {
+			ngot, err = fmt.Fprintf(w, "  %q [ shape = diamond ]\n", s.label)
+			n += ngot
+			if err != nil {
+				return err
+			}
+		}
+		for _, br := range s.branches {
+			ngot, err = fmt.Fprintf(w, "  %q -> %q [ label = %q, style = \"dashed\" ];\n", s.label, br.Dst.label, branchLabel(br, "\n"))
+			n += ngot
+			if err != nil {
+				return err
+			}
+			if isSource && statesEqual(sm.actual, br.Dst) {
+				isSource = false
+			}
+		}
+		for _, tr := range s.automatic {
+			ngot, err = writeDOTentry(w, s, tr, tr.Dst)
 			n += ngot
 			if err != nil {
 				return err
@@ -50,7 +96,22 @@ func WriteDOT[T input](w io.Writer, sm *StateMachine[T]) (n int, err error) {
 				isSource = false
 			}
 		}
-		return nil
+		return s.forEachTransition(func(tr *Transition[T]) error {
+			if tr.internal || s.descends() && !statesEqual(s, tr.Src) {
+				return nil // Inherited transitions only drawn for states rested in.
+			}
+			for _, dst := range tr.destinations() {
+				ngot, err = writeDOTentry(w, s, *tr, dst)
+				n += ngot
+				if err != nil {
+					return err
+				}
+				if isSource && statesEqual(sm.actual, dst) {
+					isSource = false
+				}
+			}
+			return nil
+		})
 	})
 	if err == nil && isSource {
 		ngot, err = fmt.Fprintf(w, "  %q [ color = blue ]\n", sm.actual.label)
@@ -60,45 +121,180 @@ func WriteDOT[T input](w io.Writer, sm *StateMachine[T]) (n int, err error) {
 		return n, err
 	}
 	i := 0
-	for label, substates := range superStates {
-		ngot, err = fmt.Fprintf(w, "  subgraph cluster_%x {\n    label = %q;\n", i, label)
+	for _, c := range clusters.list {
+		if c.super.parent != nil {
+			continue // Nested in its superstate's cluster.
+		}
+		ngot, err = writeDOTcluster(w, &clusters, c, "  ", &i)
 		n += ngot
-		i++
 		if err != nil {
 			return n, err
 		}
-		for _, s := range substates {
-			ngot, err = fmt.Fprintf(w, "    %q;\n", s.label)
-			n += ngot
-			if err != nil {
-				return n, err
-			}
+	}
+	ngot, err = w.Write([]byte("}\n"))
+	n += ngot
+	return n, err
+}
+
+// writeDOTcluster writes the superstate of c as a cluster containing its
+// substates and the clusters of its substates which are superstates.
+// Orthogonal regions are drawn as dashed clusters.
+func writeDOTcluster[T input](w io.Writer, clusters *clusters[T], c *cluster[T], indent string, i *int) (n int, err error) {
+	id := *i
+	*i++
+	ngot, err := fmt.Fprintf(w, "%ssubgraph cluster_%x {\n%s  label = %q;\n", indent, id, indent, c.super.label)
+	n += ngot
+	if err != nil {
+		return n, err
+	}
+	if c.super.isRegion() {
+		ngot, err = fmt.Fprintf(w, "%s  style = dashed;\n", indent)
+		n += ngot
+		if err != nil {
+			return n, err
 		}
-		ngot, err = fmt.Fprintf(w, "  }\n")
+	}
+	if initial := c.super.initial; initial != nil {
+		ngot, err = fmt.Fprintf(w, "%s  cluster_%x_initial [ shape = point ];\n%s  cluster_%x_initial -> %q;\n", indent, id, indent, id, initial.label)
 		n += ngot
 		if err != nil {
 			return n, err
 		}
 	}
-
-	if err != nil {
-		return n, err
+	for _, pseudo := range [...]*State[T]{c.super.shallowHistory, c.super.deepHistory} {
+		if pseudo == nil {
+			continue
+		}
+		label := "H"
+		if pseudo.resumes == HistoryDeep {
+			label = "H*"
+		}
+		ngot, err = fmt.Fprintf(w, "%s  %q [ shape = circle, label = %q ];\n", indent, pseudo.label, label)
+		n += ngot
+		if err != nil {
+			return n, err
+		}
 	}
-	ngot, err = w.Write([]byte("}\n"))
+	for _, s := range c.substates {
+		if s.isRegion() {
+			continue // Regions are drawn as clusters only.
+		}
+		ngot, err = fmt.Fprintf(w, "%s  %q;\n", indent, s.label)
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+	}
+	for _, s := range c.substates {
+		if sub := clusters.get(s); sub != nil {
+			ngot, err = writeDOTcluster(w, clusters, sub, indent+"  ", i)
+			n += ngot
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	ngot, err = fmt.Fprintf(w, "%s}\n", indent)
 	n += ngot
 	return n, err
 }
 
-func writeDOTentry[T input](w io.Writer, tr Transition[T]) (int, error) {
+// cluster is a superstate and its substates found when walking a state machine.
+type cluster[T input] struct {
+	super     *State[T]
+	substates []*State[T]
+}
+
+// clusters contains the superstates found when walking a state machine in the order found.
+type clusters[T input] struct {
+	list []*cluster[T]
+}
+
+// add adds s and its ancestors to the clusters of their superstates.
+func (cs *clusters[T]) add(s *State[T]) {
+	for ; s.parent != nil; s = s.parent {
+		c := cs.get(s.parent)
+		if c == nil {
+			c = &cluster[T]{super: s.parent}
+			cs.list = append(cs.list, c)
+		}
+		for _, sub := range c.substates {
+			if statesEqual(sub, s) {
+				return // Ancestors already added.
+			}
+		}
+		c.substates = append(c.substates, s)
+	}
+}
+
+// get returns the cluster of superstate s or nil if s has no substates in clusters.
+func (cs *clusters[T]) get(s *State[T]) *cluster[T] {
+	for _, c := range cs.list {
+		if statesEqual(c.super, s) {
+			return c
+		}
+	}
+	return nil
+}
+
+// writeDOTentry writes the transition tr as an edge leaving state s towards dst.
+// Transitions inherited by s from a superstate are drawn in gray.
+func writeDOTentry[T input](w io.Writer, s *State[T], tr Transition[T], dst *State[T]) (int, error) {
 	var style string = "solid"
 	if tr.HasGuards() {
 		style = "dashed"
 	}
 	label := tr.Trigger.String()
+	if d, ok := s.timerDuration(tr.Trigger); ok {
+		label += "\nafter(" + d.String() + ")"
+	}
+	if tr.IsDynamic() {
+		label += "\n(" + tr.selector.label + ")"
+	}
 	for i := range tr.guards {
 		label += "\n[" + tr.guards[i].label + "]"
 	}
-	return fmt.Fprintf(w, "  %q -> %q [ label = %q, style = %q ];\n", tr.Src.label, tr.Dst.label, label, style)
+	if tr.HasEffect() {
+		label += "\n/ " + tr.effect.label
+	}
+	if !statesEqual(s, tr.Src) {
+		return fmt.Fprintf(w, "  %q -> %q [ label = %q, style = %q, color = gray ];\n", s.label, dst.label, label, style)
+	}
+	if tr.Trigger == TriggerAutomatic {
+		return fmt.Fprintf(w, "  %q -> %q [ label = %q, style = %q, penwidth = 2 ];\n", tr.Src.label, dst.label, label, style)
+	}
+	return fmt.Fprintf(w, "  %q -> %q [ label = %q, style = %q ];\n", tr.Src.label, dst.label, label, style)
+}
+
+// branchLabel returns the guard clauses of the choice branch br each enclosed
+// in square brackets and separated by sep, or "[else]" for the else branch.
+func branchLabel[T input](br Transition[T], sep string) (label string) {
+	if !br.HasGuards() {
+		return "[else]"
+	}
+	for i := range br.guards {
+		if i > 0 {
+			label += sep
+		}
+		label += "[" + br.guards[i].label + "]"
+	}
+	return label
+}
+
+// internalLabel returns the internal transitions registered on s each preceded
+// by sep and formatted as "trigger [guard] / action", or an empty string if s has none.
+func internalLabel[T input](s *State[T], sep string) (label string) {
+	for _, tr := range s.transitions {
+		if !tr.internal {
+			continue
+		}
+		label += sep + tr.Trigger.String()
+		for i := range tr.guards {
+			label += " [" + tr.guards[i].label + "]"
+		}
+		label += " / " + tr.effect.label
+	}
+	return label
 }
 
 type diagConfig struct {
@@ -111,52 +307,125 @@ func writeMermaidStateDiagram[T any](w io.Writer, sm *StateMachine[T], cfg diagC
 		return n, err
 	}
 	isSource := true
-	superStates := make(map[string][]*State[T])
+	var clusters clusters[T]
 	// Mermaid state diagram v2. See https://mermaid-js.github.io/mermaid/#/stateDiagram
 	err = WalkStates(sm.actual, func(s *State[T]) error {
-		if s.parent != nil {
-			superStates[s.parent.label] = append(superStates[s.parent.label], s)
-		}
+		clusters.add(s)
 		key := hash(s.label)
-		ngot, _ := fmt.Fprintf(w, "  state%x:%s\n", key, s.label)
+		if s.choice {
+			ngot, _ = fmt.Fprintf(w, "  state state%x <<choice>>\n", key)
+		} else {
+			ngot, _ = fmt.Fprintf(w, "  state%x:%s%s\n", key, s.label, internalLabel(s, "<br/>"))
+		}
 		n += ngot
-		for i := 0; i < len(s.transitions); i++ {
-			tr := s.transitions[i]
-			ngot, err = writeMermaidEntry(w, tr)
+		for _, pseudo := range [...]*State[T]{s.shallowHistory, s.deepHistory} {
+			if pseudo != nil {
+				ngot, _ = fmt.Fprintf(w, "  state%x:%s\n", hash(pseudo.label), pseudo.label)
+				n += ngot
+			}
+		}
+		if s.final {
+			ngot, _ = fmt.Fprintf(w, "  state%x --> [*]\n", key)
+			n += ngot
+		}
+		for _, br := range s.branches {
+			ngot, err = fmt.Fprintf(w, "  state%x --> state%x:%s\n", key, hash(br.Dst.label), branchLabel(br, " "))
 			n += ngot
 			if err != nil {
 				return err
 			}
-			if isSource && statesEqual(sm.actual, tr.Dst) {
-				isSource = false
+		}
+		for _, tr := range s.automatic {
+			ngot, err = writeMermaidEntry(w, tr)
+			n += ngot
+			if err != nil {
+				return err
 			}
 		}
-		return nil
+		return s.forEachTransition(func(tr *Transition[T]) error {
+			if tr.internal || s.descends() && !statesEqual(s, tr.Src) {
+				return nil // Inherited transitions only drawn for states rested in.
+			}
+			edge := *tr
+			edge.Src = s // Inherited transitions leave from the substate.
+			for _, dst := range tr.destinations() {
+				edge.Dst = dst
+				ngot, err = writeMermaidEntry(w, edge)
+				n += ngot
+				if err != nil {
+					return err
+				}
+				if isSource && statesEqual(sm.actual, dst) {
+					isSource = false
+				}
+			}
+			return nil
+		})
 	})
 	if err != nil {
 		return n, err
 	}
-	i := 0
-	for label, substates := range superStates {
-		ngot, err = fmt.Fprintf(w, "  state state%x {\n", hash(label))
+	for _, c := range clusters.list {
+		if c.super.parent != nil {
+			continue // Nested in its superstate's composite state.
+		}
+		ngot, err = writeMermaidComposite(w, &clusters, c, "  ")
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// writeMermaidComposite writes the superstate of c as a composite state. Orthogonal
+// regions are separated by the concurrency separator "--".
+func writeMermaidComposite[T input](w io.Writer, clusters *clusters[T], c *cluster[T], indent string) (n int, err error) {
+	ngot, err := fmt.Fprintf(w, "%sstate state%x {\n", indent, hash(c.super.label))
+	n += ngot
+	if err != nil {
+		return n, err
+	}
+	if initial := c.super.initial; initial != nil {
+		ngot, err = fmt.Fprintf(w, "%s  [*] --> state%x\n", indent, hash(initial.label))
 		n += ngot
-		i++
 		if err != nil {
 			return n, err
 		}
-		for _, s := range substates {
-			ngot, err = fmt.Fprintf(w, "    state%x\n", hash(s.label))
+	}
+	for _, pseudo := range [...]*State[T]{c.super.shallowHistory, c.super.deepHistory} {
+		if pseudo != nil {
+			ngot, err = fmt.Fprintf(w, "%s  state%x\n", indent, hash(pseudo.label))
 			n += ngot
 			if err != nil {
 				return n, err
 			}
 		}
-		ngot, err = fmt.Fprintf(w, "  }\n")
+	}
+	regions := 0
+	for _, s := range c.substates {
+		if s.isRegion() {
+			if regions > 0 {
+				ngot, err = fmt.Fprintf(w, "%s  --\n", indent)
+				n += ngot
+				if err != nil {
+					return n, err
+				}
+			}
+			regions++
+		}
+		if sub := clusters.get(s); sub != nil {
+			ngot, err = writeMermaidComposite(w, clusters, sub, indent+"  ")
+		} else {
+			ngot, err = fmt.Fprintf(w, "%s  state%x\n", indent, hash(s.label))
+		}
 		n += ngot
 		if err != nil {
 			return n, err
 		}
 	}
+	ngot, err = fmt.Fprintf(w, "%s}\n", indent)
+	n += ngot
 	return n, err
 }
 
@@ -166,6 +435,9 @@ func writeMermaidEntry[T input](w io.Writer, tr Transition[T]) (int, error) {
 		style = "-->>"
 	}
 	trigLable := tr.Trigger.String()
+	for i := range tr.guards {
+		trigLable += " [" + tr.guards[i].label + "]"
+	}
 	return fmt.Fprintf(w, "  state%x %s state%x:%s\n", hash(tr.Src.Label()), style, hash(tr.Dst.Label()), trigLable)
 }
 
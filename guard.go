@@ -0,0 +1,118 @@
+package maquina
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNegatedGuardPassed is returned by a guard clause created with Not when the
+// guard clause it negates passes.
+var ErrNegatedGuardPassed = errors.New("negated guard clause passed")
+
+// guardOp is the boolean operator a composite guard clause applies to its operands.
+type guardOp uint8
+
+const (
+	guardLeaf guardOp = iota
+	guardAll
+	guardAny
+	guardNot
+)
+
+// And returns a guard clause that passes if both a and b pass. See [All].
+func And[T input](a, b GuardClause[T]) GuardClause[T] { return All(a, b) }
+
+// Or returns a guard clause that passes if a or b passes. See [Any].
+func Or[T input](a, b GuardClause[T]) GuardClause[T] { return Any(a, b) }
+
+// All returns a guard clause that passes if all guards pass. Guards are evaluated
+// in order and evaluation stops at the first that fails, whose GuardClauseError is
+// returned. The label of the guard clause is the boolean expression of the labels
+// of guards, i.e: "fresh quote and within limit".
+func All[T input](guards ...GuardClause[T]) GuardClause[T] {
+	gc := newCompositeGuard(guardAll, guards)
+	guards = gc.operands
+	gc.guard = func(ctx context.Context, input T) error {
+		for i := range guards {
+			if err := guards[i].guard(ctx, input); err != nil {
+				return &GuardClauseError{Label: guards[i].label, err: err}
+			}
+		}
+		return nil
+	}
+	return gc
+}
+
+// Any returns a guard clause that passes if any of guards passes. Guards are
+// evaluated in order and evaluation stops at the first that passes. If all fail
+// the GuardClauseError of each is returned joined. The label of the guard clause
+// is the boolean expression of the labels of guards, i.e: "manual or automated".
+func Any[T input](guards ...GuardClause[T]) GuardClause[T] {
+	gc := newCompositeGuard(guardAny, guards)
+	guards = gc.operands
+	gc.guard = func(ctx context.Context, input T) error {
+		var errs []error
+		for i := range guards {
+			err := guards[i].guard(ctx, input)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, &GuardClauseError{Label: guards[i].label, err: err})
+		}
+		return joinErrors(errs)
+	}
+	return gc
+}
+
+// Not returns a guard clause that passes if guard fails. It returns
+// ErrNegatedGuardPassed if guard passes. Its label is that of guard
+// preceded by "not", i.e: "not halted".
+func Not[T input](guard GuardClause[T]) GuardClause[T] {
+	gc := newCompositeGuard(guardNot, []GuardClause[T]{guard})
+	gc.guard = func(ctx context.Context, input T) error {
+		if guard.guard(ctx, input) == nil {
+			return ErrNegatedGuardPassed
+		}
+		return nil
+	}
+	return gc
+}
+
+// newCompositeGuard returns a guard clause applying op to operands labelled with
+// their boolean expression. Its guard function must be set by the caller.
+func newCompositeGuard[T input](op guardOp, operands []GuardClause[T]) GuardClause[T] {
+	if len(operands) == 0 {
+		panic("composite guard clause has no operands")
+	}
+	var label string
+	for i, operand := range operands {
+		if operand.guard == nil {
+			panic("nil guard clause operand")
+		}
+		switch {
+		case op == guardNot:
+			label = "not "
+		case i == 0:
+		case op == guardAll:
+			label += " and "
+		default:
+			label += " or "
+		}
+		if operand.op == guardLeaf || operand.op == guardNot || operand.op == op {
+			label += operand.label
+		} else {
+			label += "(" + operand.label + ")"
+		}
+	}
+	operands = append([]GuardClause[T]{}, operands...)
+	return GuardClause[T]{label: label, op: op, operands: operands}
+}
+
+// Operands returns a copy of the guard clauses gc was composed of with All, Any,
+// And, Or or Not. It returns nil if gc was created with NewGuard.
+func (gc GuardClause[T]) Operands() []GuardClause[T] {
+	if gc.operands == nil {
+		return nil
+	}
+	return append([]GuardClause[T]{}, gc.operands...)
+}
@@ -3,6 +3,8 @@ package maquina
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 )
 
 // input is an alias for any for the time being. Will probably remain as such
@@ -19,6 +21,34 @@ type Transition[T input] struct {
 	Dst     *State[T]
 	Trigger Trigger
 	guards  []GuardClause[T]
+	// selector chooses Dst during the transition for dynamic transitions.
+	selector DestinationSelector[T]
+	// effect is run during the transition if set.
+	effect FringeCallback[T]
+	// internal transitions run their effect without leaving the state.
+	internal bool
+	// resume is the history Dst resumes in if the transition targeted one of
+	// its history pseudo-states.
+	resume History
+}
+
+// IsInternal returns true if the transition is an internal transition which runs
+// its action without exiting, entering or reentering any state. See [State.InternalTransition].
+func (t Transition[T]) IsInternal() bool { return t.internal }
+
+// IsDynamic returns true if the destination of the transition is chosen by a
+// DestinationSelector during the transition. See [State.PermitDynamic].
+func (t Transition[T]) IsDynamic() bool { return t.selector.selector != nil }
+
+// Selector returns the DestinationSelector of a dynamic transition.
+func (t Transition[T]) Selector() DestinationSelector[T] { return t.selector }
+
+// destinations returns all possible destinations of the transition.
+func (t Transition[T]) destinations() []*State[T] {
+	if t.IsDynamic() {
+		return t.selector.dsts
+	}
+	return []*State[T]{t.Dst}
 }
 
 // HasGuards returns true if the transition has any guard clauses.
@@ -27,6 +57,12 @@ func (t Transition[T]) HasGuards() bool { return len(t.guards) > 0 }
 // IsReentry checks if the transition is a reentry transition.
 func (t Transition[T]) IsReentry() bool { return statesEqual(t.Src, t.Dst) }
 
+// HasEffect checks if the transition has an effect. See [State.PermitWithEffect].
+func (t Transition[T]) HasEffect() bool { return t.effect.cb != nil }
+
+// Effect returns the effect run during the transition or the zero value if it has none.
+func (t Transition[T]) Effect() FringeCallback[T] { return t.effect }
+
 // Guards returns a copy of the guard clauses for the transition.
 func (t Transition[T]) Guards() []GuardClause[T] {
 	return append([]GuardClause[T]{}, t.guards...) // clone guard clauses
@@ -38,6 +74,9 @@ func (t Transition[T]) Guards() []GuardClause[T] {
 type GuardClause[T input] struct {
 	label string
 	guard func(ctx context.Context, input T) error
+	// op and operands are set for guard clauses composed with All, Any or Not.
+	op       guardOp
+	operands []GuardClause[T]
 }
 
 // String returns the label with which gc was created.
@@ -53,6 +92,55 @@ func NewGuard[T input](label string, guard func(ctx context.Context, input T) er
 	return GuardClause[T]{label: label, guard: guard}
 }
 
+// DestinationSelector chooses the destination state of a dynamic transition
+// based on the context and input of the transition. See [State.PermitDynamic].
+type DestinationSelector[T input] struct {
+	label    string
+	selector func(ctx context.Context, input T) *State[T]
+	dsts     []*State[T]
+}
+
+// String returns the label with which ds was created.
+func (ds DestinationSelector[T]) String() string { return ds.label }
+
+// Destinations returns a copy of the possible destinations declared for ds.
+func (ds DestinationSelector[T]) Destinations() []*State[T] {
+	return append([]*State[T]{}, ds.dsts...)
+}
+
+// NewDestinationSelector instantiates a new DestinationSelector with a label and
+// a selector function which must return one of the possible destinations.
+// All possible destinations must be declared so that the state machine's
+// transitions may be walked and graphed.
+func NewDestinationSelector[T input](label string, selector func(ctx context.Context, input T) *State[T], possibleDsts ...*State[T]) DestinationSelector[T] {
+	if label == "" {
+		panic("empty destination selector label")
+	} else if selector == nil {
+		panic("nil destination selector function")
+	} else if len(possibleDsts) == 0 {
+		panic("destination selector has no possible destinations")
+	}
+	for _, dst := range possibleDsts {
+		if dst == nil {
+			panic("nil possible destination state")
+		}
+	}
+	return DestinationSelector[T]{label: label, selector: selector, dsts: possibleDsts}
+}
+
+// selectDst calls the selector and checks the returned state is a declared destination.
+func (ds DestinationSelector[T]) selectDst(ctx context.Context, input T) (*State[T], error) {
+	dst := ds.selector(ctx, input)
+	if dst != nil {
+		for _, possible := range ds.dsts {
+			if statesEqual(dst, possible) {
+				return dst, nil
+			}
+		}
+	}
+	return nil, errors.New("destination selector \"" + ds.label + "\" returned undeclared destination")
+}
+
 type triggeredFunc[T input] struct {
 	t Trigger
 	f FringeCallback[T]
@@ -62,7 +150,9 @@ type triggeredFunc[T input] struct {
 // transition. It can be used to execute code on entry, exit or reentry of a state.
 type FringeCallback[T input] struct {
 	label string
-	cb    func(ctx context.Context, tr Transition[T], input T)
+	cb    func(ctx context.Context, tr Transition[T], input T) error
+	// compensation is run to undo cb if the transition fails after cb was run.
+	compensation *FringeCallback[T]
 }
 
 // String returns the label with which cb was created.
@@ -72,6 +162,25 @@ func (cb FringeCallback[T]) String() string { return cb.label }
 // that is executed on the fringe of a state transition.
 // The label is used for printing of the callback and does not need to be unique.
 func NewFringeCallback[T input](label string, callback func(ctx context.Context, tr Transition[T], input T)) FringeCallback[T] {
+	if label == "" {
+		panic("empty fringe callback label")
+	} else if callback == nil {
+		panic("nil fringe callback function")
+	}
+	return NewFallibleCallback(label, func(ctx context.Context, tr Transition[T], input T) error {
+		callback(ctx, tr, input)
+		return nil
+	})
+}
+
+// NewFallibleCallback instantiates a new FringeCallback with a label and a callback
+// that may fail. If an entry, exit or reentry callback or a transition effect returns
+// an error the transition is rolled back: the compensations of the callbacks already
+// run during the transition are run in reverse order and the state machine remains
+// in the source state. Fire then returns a CallbackError. Errors returned by callbacks
+// registered on the state machine, such as with OnTransitioned, are discarded.
+// See [FringeCallback.WithCompensation].
+func NewFallibleCallback[T input](label string, callback func(ctx context.Context, tr Transition[T], input T) error) FringeCallback[T] {
 	if label == "" {
 		panic("empty fringe callback label")
 	} else if callback == nil {
@@ -80,6 +189,27 @@ func NewFringeCallback[T input](label string, callback func(ctx context.Context,
 	return FringeCallback[T]{label: label, cb: callback}
 }
 
+// WithCompensation returns a copy of cb with a compensation callback which undoes
+// the work of cb. The compensation is run with the same transition and input as cb
+// if a callback run after cb fails during the same transition. Errors returned by
+// compensations are discarded.
+func (cb FringeCallback[T]) WithCompensation(compensation FringeCallback[T]) FringeCallback[T] {
+	if compensation.cb == nil {
+		panic("nil compensation callback")
+	}
+	cb.compensation = &compensation
+	return cb
+}
+
+// Compensation returns the compensation of cb set with WithCompensation or the
+// zero value if it has none.
+func (cb FringeCallback[T]) Compensation() FringeCallback[T] {
+	if cb.compensation == nil {
+		return FringeCallback[T]{}
+	}
+	return *cb.compensation
+}
+
 // String returns the trigger string with which it was created.
 func (t Trigger) String() string { return string(t) }
 
@@ -92,86 +222,619 @@ func (t Trigger) Quote() string { return "\"" + t.String() + "\"" }
 // which should always run regardless of the transition.
 const triggerWildcard Trigger = "*"
 
+// TriggerAutomatic is the trigger of automatic transitions registered with
+// [State.PermitAutomatic]. It may be used to register entry and exit callbacks
+// that run only on automatic transitions but may not be fired.
+const TriggerAutomatic Trigger = "(automatic)"
+
+// TriggerDone is the trigger of completion transitions. A transition registered
+// for TriggerDone on a superstate is taken once the superstate is completed by
+// resting in a final substate, or a final substate in each of its regions. Like
+// automatic transitions, completion transitions are not inherited by substates
+// and TriggerDone may not be fired. See [State.SetFinal].
+const TriggerDone Trigger = "(done)"
+
+// TriggerFault is the trigger of the transition into the fault state taken after a
+// panic is recovered under the PanicFault policy. It may be used to register entry
+// callbacks that run only when entering the fault state but may not be fired.
+// See [StateMachine.SetPanicPolicy].
+const TriggerFault Trigger = "(fault)"
+
 // triggersEqual checks if a trigger is equal to another trigger or the wildcard.
 // Should only be used for checking if a callback should be run.
 func triggersEqual(a, b Trigger) bool          { return a == b || a == triggerWildcard || b == triggerWildcard }
-func statesEqual[T input](a, b *State[T]) bool { return a.label == b.label }
-
-func (sm *StateMachine[T]) exit(ctx context.Context, tr Transition[T], input T) {
-	if tr.Dst.parent != nil && tr.Src.Contains(tr.Dst) {
-		return // Do not exit parent state if transitioning to a substate.
-	}
-	s := tr.Src
-	for i := 0; i < len(s.exitFuncs); i++ {
-		if triggersEqual(s.exitFuncs[i].t, tr.Trigger) {
-			fringe := s.exitFuncs[i].f
-			if sm.onFringe != nil {
-				sm.onFringe(tr, fringe, input)
+func statesEqual[T input](a, b *State[T]) bool { return a == b || a.label == b.label }
+
+// transitionDomain returns the innermost state among src and its ancestors
+// that contains dst. A transition from src to dst exits the active states
+// below the domain and enters the states below the domain down to dst.
+// It returns nil if no such state exists.
+func transitionDomain[T input](src, dst *State[T]) *State[T] {
+	for s := src; s != nil; s = s.parent {
+		if s.Contains(dst) {
+			return s
+		}
+	}
+	return nil
+}
+
+// below returns true if s is a substate of domain. All states are below a nil domain.
+func below[T input](s, domain *State[T]) bool {
+	return domain == nil || (!statesEqual(s, domain) && domain.Contains(s))
+}
+
+// exit runs the exit callbacks of the active states below domain, innermost
+// first, and removes the exited leaves from the active configuration. States
+// shared by several active leaves, such as a superstate with orthogonal regions,
+// are exited after all their substates. It returns the index of the first
+// leaf removed.
+// If an exit callback fails its error is returned and the exit is aborted.
+func (sm *StateMachine[T]) exit(ctx context.Context, tr Transition[T], domain *State[T], input T) (removedAt int, err error) {
+	if len(sm.leaves) == 1 {
+		return sm.exitLeaf(ctx, tr, domain, input)
+	}
+	removedAt = -1
+	for i := 0; i < len(sm.leaves); i++ {
+		leaf := sm.leaves[i]
+		if !sm.exits(leaf, domain) {
+			continue
+		}
+		if removedAt < 0 {
+			removedAt = i
+		}
+		for s := leaf; s != nil && below(s, domain); s = s.parent {
+			if sm.containsLeafAfter(s, i) {
+				break // Exited along with the last of its active substates.
 			}
-			fringe.cb(ctx, tr, input)
+			tr.Src = s
+			if err := sm.exitState(ctx, tr, s, input); err != nil {
+				return -1, err
+			}
+			if s.recordsHistory() {
+				sm.recordHistory(s, leaf)
+			}
+		}
+	}
+	if removedAt < 0 {
+		return len(sm.leaves), nil
+	}
+	kept := sm.leaves[:removedAt]
+	for _, leaf := range sm.leaves[removedAt:] {
+		if !sm.exits(leaf, domain) {
+			kept = append(kept, leaf)
+		}
+	}
+	sm.leaves = kept
+	return removedAt, nil
+}
+
+// exitLeaf is exit for a state machine with a single active leaf.
+func (sm *StateMachine[T]) exitLeaf(ctx context.Context, tr Transition[T], domain *State[T], input T) (removedAt int, err error) {
+	leaf := sm.leaves[0]
+	if !sm.exits(leaf, domain) {
+		return 1, nil
+	}
+	for s := leaf; s != nil && below(s, domain); s = s.parent {
+		tr.Src = s
+		if err := sm.exitState(ctx, tr, s, input); err != nil {
+			return -1, err
+		}
+		if s.recordsHistory() {
+			sm.recordHistory(s, leaf)
+		}
+	}
+	sm.leaves = sm.leaves[:0]
+	return 0, nil
+}
+
+// exits returns true if the active leaf is removed from the active configuration
+// by a transition with the given domain. A leaf equal to the domain is removed
+// without being exited since the transition enters one of its substates.
+func (sm *StateMachine[T]) exits(leaf, domain *State[T]) bool {
+	return below(leaf, domain) || statesEqual(leaf, domain)
+}
+
+// containsLeafAfter returns true if s contains an active leaf after the i'th.
+func (sm *StateMachine[T]) containsLeafAfter(s *State[T], i int) bool {
+	for _, leaf := range sm.leaves[i+1:] {
+		if s.Contains(leaf) {
+			return true
+		}
+	}
+	return false
+}
+
+// enter runs the entry callbacks of the states below domain down to and
+// including tr.Dst, outermost first. Then it descends into tr.Dst and into the
+// orthogonal regions of the domain and the states entered that do not contain
+// tr.Dst, adding the entered leaves to the active configuration at index at.
+// If an entry callback fails its error is returned and the entry is aborted.
+func (sm *StateMachine[T]) enter(ctx context.Context, tr Transition[T], domain *State[T], at int, input T) error {
+	n := len(sm.leaves)
+	if domain == nil || !statesEqual(domain, tr.Dst) {
+		if err := sm.enterDown(ctx, tr, domain, tr.Dst, input); err != nil {
+			return err
+		}
+	}
+	if targets := sm.historyTargets(tr.Dst, tr.resume); len(targets) > 0 {
+		if err := sm.descendTo(ctx, tr, tr.Dst, targets, input); err != nil {
+			return err
+		}
+	} else if err := sm.descend(ctx, tr, tr.Dst, input); err != nil {
+		return err
+	}
+	for s := tr.Dst; s.parent != nil && sm.exits(s.parent, domain); s = s.parent {
+		for _, region := range s.parent.regions {
+			if statesEqual(region, s) {
+				continue
+			}
+			tr.Dst = region
+			if err := sm.enterState(ctx, tr, region, input); err != nil {
+				return err
+			}
+			if err := sm.descend(ctx, tr, region, input); err != nil {
+				return err
+			}
+		}
+	}
+	// Move entered leaves into place.
+	rotate(sm.leaves[at:], len(sm.leaves)-n)
+	return nil
+}
+
+// descend enters the initial substate of s recursively, or the substate recorded
+// if s has history, running the entry callbacks of each substate entered.
+// If s has orthogonal regions each region is entered and descended into.
+// The innermost states entered are appended to the active configuration.
+func (sm *StateMachine[T]) descend(ctx context.Context, tr Transition[T], s *State[T], input T) error {
+	for _, region := range s.regions {
+		tr.Dst = region
+		if err := sm.enterState(ctx, tr, region, input); err != nil {
+			return err
+		}
+		if err := sm.descend(ctx, tr, region, input); err != nil {
+			return err
 		}
 	}
-	if tr.Src.parent != nil && !tr.Src.parent.Contains(tr.Dst) {
-		newTr := tr
-		newTr.Src = tr.Src.parent
-		sm.exit(ctx, newTr, input)
+	if len(s.regions) > 0 {
+		return nil
+	}
+	if targets := sm.historyTargets(s, s.history); len(targets) > 0 {
+		return sm.descendTo(ctx, tr, s, targets, input)
+	}
+	next := s.initial
+	if next == nil {
+		sm.leaves = append(sm.leaves, s)
+		return nil
+	}
+	if err := sm.enterDown(ctx, tr, s, next, input); err != nil {
+		return err
+	}
+	return sm.descend(ctx, tr, next, input)
+}
+
+// descendTo enters the states below s down to the recorded states targets,
+// entering every orthogonal region along the way. Regions and states containing
+// no target are entered through their initial states.
+func (sm *StateMachine[T]) descendTo(ctx context.Context, tr Transition[T], s *State[T], targets []*State[T], input T) error {
+	var within []*State[T]
+	for _, target := range targets {
+		if below(target, s) {
+			within = append(within, target)
+		}
+	}
+	if len(within) == 0 {
+		return sm.descend(ctx, tr, s, input)
+	}
+	for _, region := range s.regions {
+		tr.Dst = region
+		if err := sm.enterState(ctx, tr, region, input); err != nil {
+			return err
+		}
+		if err := sm.descendTo(ctx, tr, region, within, input); err != nil {
+			return err
+		}
+	}
+	if len(s.regions) > 0 {
+		return nil
+	}
+	next := within[0]
+	for next.parent != s {
+		next = next.parent
+	}
+	tr.Dst = next
+	if err := sm.enterState(ctx, tr, next, input); err != nil {
+		return err
+	}
+	return sm.descendTo(ctx, tr, next, within, input)
+}
+
+// enterDown runs the entry callbacks of the states below superstate from
+// down to and including its substate to, outermost first. If from is nil
+// all ancestors of to are entered.
+func (sm *StateMachine[T]) enterDown(ctx context.Context, tr Transition[T], from, to *State[T], input T) error {
+	if to.parent != nil && to.parent != from {
+		if err := sm.enterDown(ctx, tr, from, to.parent, input); err != nil {
+			return err
+		}
+	}
+	tr.Dst = to
+	return sm.enterState(ctx, tr, to, input)
+}
+
+// enterState runs the entry callbacks of s and starts its timers and activities.
+func (sm *StateMachine[T]) enterState(ctx context.Context, tr Transition[T], s *State[T], input T) error {
+	sm.journal.entered = append(sm.journal.entered, s)
+	sm.entering = s
+	err := sm.runFringes(ctx, tr, PhaseEntry, s.entryFuncs, input)
+	if err == nil && !sm.dryRun {
+		sm.startState(s, input)
 	}
+	sm.entering = nil
+	return err
 }
 
-func (sm *StateMachine[T]) enter(ctx context.Context, tr Transition[T], input T) {
-	if tr.Src.parent != nil && tr.Dst.Contains(tr.Src) {
-		return // Transition from a substate.
+// exitState stops the activities of s, runs its exit callbacks and suspends its
+// timers and context until the transition completes.
+func (sm *StateMachine[T]) exitState(ctx context.Context, tr Transition[T], s *State[T], input T) error {
+	sm.journal.exited = append(sm.journal.exited, s)
+	if len(s.timers) > 0 && !sm.dryRun {
+		sm.suspendTimers(s)
 	}
-	if tr.Dst.parent != nil && !tr.Dst.parent.Contains(tr.Src) {
-		newTr := tr
-		newTr.Dst = tr.Dst.parent
-		sm.enter(ctx, newTr, input)
+	if len(s.activities) > 0 && !sm.dryRun {
+		sm.stopActivities(ctx, s)
+	}
+	if err := sm.runFringes(ctx, tr, PhaseExit, s.exitFuncs, input); err != nil {
+		return err
+	}
+	if len(sm.contexts) > 0 && !sm.dryRun {
+		sm.suspendStateContext(s)
+	}
+	return nil
+}
+
+// startState starts the timers and activities of the active state s.
+func (sm *StateMachine[T]) startState(s *State[T], input T) {
+	if len(s.timers) > 0 {
+		sm.startTimers(s, input)
+	}
+	if len(s.activities) > 0 {
+		sm.startActivities(s, input)
+	}
+}
+
+// stopState stops the timers and activities of s.
+func (sm *StateMachine[T]) stopState(ctx context.Context, s *State[T]) {
+	if len(s.timers) > 0 {
+		sm.stopTimers(s)
+	}
+	if len(s.activities) > 0 {
+		sm.stopActivities(ctx, s)
+	}
+}
+
+// rotate moves the last n elements of s to its front preserving order.
+func rotate[E any](s []E, n int) {
+	reverse(s)
+	reverse(s[:n])
+	reverse(s[n:])
+}
+
+func reverse[E any](s []E) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
 	}
-	s := tr.Dst
-	for i := 0; i < len(s.entryFuncs); i++ {
-		if triggersEqual(s.entryFuncs[i].t, tr.Trigger) {
-			fringe := s.entryFuncs[i].f
-			if sm.onFringe != nil {
-				sm.onFringe(tr, fringe, input)
+}
+
+// recordHistory records the substates of superstate s the state machine is
+// exiting from according to the history kind of s, leaf being the active
+// leaf state exited. Shallow history records the direct substate of s containing
+// leaf and deep history the active leaf of each orthogonal region within s.
+// Deep history is recorded if s has a deep history pseudo-state, since the
+// shallow history can be derived from it. Superstates with orthogonal regions
+// record no history.
+func (sm *StateMachine[T]) recordHistory(s, leaf *State[T]) {
+	if len(s.regions) > 0 {
+		return
+	}
+	var recorded []*State[T]
+	if s.history == HistoryShallow && s.deepHistory == nil {
+		child := leaf
+		for child != nil && child.parent != s {
+			child = child.parent
+		}
+		if child != nil {
+			recorded = append(recorded, child)
+		}
+	} else {
+		for _, active := range sm.leaves {
+			if below(active, s) {
+				recorded = append(recorded, active)
 			}
-			fringe.cb(ctx, tr, input)
 		}
 	}
+	if len(recorded) == 0 {
+		return
+	}
+	if sm.history == nil {
+		sm.history = make(map[string][]*State[T])
+	}
+	sm.journal.history = append(sm.journal.history, recordedHistory[T]{label: s.label, prev: sm.history[s.label]})
+	sm.history[s.label] = recorded
 }
 
-func (sm *StateMachine[T]) reenter(ctx context.Context, tr Transition[T], input T) {
-	s := tr.Dst
-	for i := 0; i < len(s.reentryFuncs); i++ {
-		if triggersEqual(s.reentryFuncs[i].t, tr.Trigger) {
-			fringe := s.reentryFuncs[i].f
-			if sm.onFringe != nil {
-				sm.onFringe(tr, fringe, input)
+// historyTargets returns the states resumed when entering superstate s with the
+// given history kind, or nil if kind is HistoryNone or s has no recorded history.
+func (sm *StateMachine[T]) historyTargets(s *State[T], kind History) []*State[T] {
+	recorded := sm.history[s.label]
+	if kind == HistoryNone || len(recorded) == 0 {
+		return nil
+	}
+	if kind == HistoryShallow {
+		child := recorded[0]
+		for child.parent != s {
+			child = child.parent
+		}
+		if len(recorded) > 1 || recorded[0] != child {
+			return []*State[T]{child}
+		}
+	}
+	return recorded
+}
+
+func (sm *StateMachine[T]) reenter(ctx context.Context, tr Transition[T], input T) error {
+	return sm.runFringes(ctx, tr, PhaseReentry, tr.Dst.reentryFuncs, input)
+}
+
+// runFringes runs the callbacks in fns whose trigger matches that of tr.
+func (sm *StateMachine[T]) runFringes(ctx context.Context, tr Transition[T], phase Phase, fns []triggeredFunc[T], input T) error {
+	for i := 0; i < len(fns); i++ {
+		if triggersEqual(fns[i].t, tr.Trigger) {
+			if err := sm.runFringe(ctx, tr, phase, fns[i].f, input); err != nil {
+				return err
 			}
-			fringe.cb(ctx, tr, input)
 		}
 	}
+	return nil
 }
 
-// fire returns error if transition was unable to be completed
-// in which case the state remains same as before.
-//
-// fire should panic if transition started, that is to say any exit
-// or entry function was run and encountered an error since this would
-// leave the state machine in an undefined state. Guard clauses should
-// prevent this from happening.
+// runFringe runs fringe during the given phase of tr. Callbacks with a
+// compensation are recorded so that they may be compensated on rollback.
+// During a dry run the callback is recorded without being run.
+func (sm *StateMachine[T]) runFringe(ctx context.Context, tr Transition[T], phase Phase, fringe FringeCallback[T], input T) error {
+	if sm.dryRun {
+		sm.recordCallback(fringe.label, phase, phaseState(phase, tr), false, 0)
+		return nil
+	}
+	if sm.onFringe != nil {
+		sm.onFringe(tr, fringe, input)
+	}
+	sm.site = callSite{phase: phase, label: fringe.label}
+	var start time.Time
+	if sm.result != nil {
+		start = time.Now()
+	}
+	err := fringe.cb(ctx, tr, input)
+	if sm.result != nil {
+		sm.recordCallback(fringe.label, phase, phaseState(phase, tr), false, time.Since(start))
+	}
+	if err != nil {
+		return &CallbackError{Label: fringe.label, Phase: phase, State: phaseState(phase, tr).label, Trigger: tr.Trigger, err: err}
+	}
+	if fringe.compensation != nil {
+		sm.journal.ran = append(sm.journal.ran, ranFringe[T]{tr: tr, phase: phase, fringe: fringe})
+	}
+	return nil
+}
+
+// journal records the changes made to a state machine by the transition in
+// progress so that it may be rolled back if a callback fails.
+type journal[T input] struct {
+	// active is set from the start of a transition until it completes.
+	active bool
+	actual *State[T]
+	leaves []*State[T]
+	// queued is the length of the trigger queue when the transition started.
+	queued  int
+	ran     []ranFringe[T]
+	exited  []*State[T]
+	entered []*State[T]
+	history []recordedHistory[T]
+	// timers and contexts of the states exited, which are stopped once the
+	// transition completes, and activities stopped, which are relaunched if
+	// the transition is rolled back.
+	timers     []activeTimer[T]
+	contexts   []stateContext[T]
+	activities []runningActivity[T]
+}
+
+// ranFringe is a callback with a compensation run during a transition.
+type ranFringe[T input] struct {
+	tr     Transition[T]
+	phase  Phase
+	fringe FringeCallback[T]
+}
+
+// recordedHistory is the history previously recorded for a superstate.
+type recordedHistory[T input] struct {
+	label string
+	prev  []*State[T]
+}
+
+// begin starts recording the changes made to sm by a transition.
+func (j *journal[T]) begin(sm *StateMachine[T]) {
+	j.reset()
+	j.active = true
+	j.actual = sm.actual
+	j.leaves = append(j.leaves[:0], sm.leaves...)
+	j.queued = len(sm.queue)
+}
+
+// reset clears the journal releasing references to states and inputs.
+func (j *journal[T]) reset() {
+	for i := range j.ran {
+		j.ran[i] = ranFringe[T]{}
+	}
+	for i := range j.activities {
+		j.activities[i] = runningActivity[T]{}
+	}
+	j.active = false
+	j.actual = nil
+	j.queued = 0
+	j.leaves = j.leaves[:0]
+	j.ran = j.ran[:0]
+	j.exited = j.exited[:0]
+	j.entered = j.entered[:0]
+	j.history = j.history[:0]
+	j.timers = j.timers[:0]
+	j.contexts = j.contexts[:0]
+	j.activities = j.activities[:0]
+}
+
+// commit completes the transition in progress stopping the timers and cancelling
+// the contexts of the states exited, and resets the journal.
+func (sm *StateMachine[T]) commit() {
+	j := &sm.journal
+	for _, at := range j.timers {
+		at.timer.Stop()
+	}
+	for _, sc := range j.contexts {
+		sc.cancel()
+	}
+	j.reset()
+}
+
+// rollback undoes the transition in progress after a callback failed. The
+// compensations of the callbacks run are run in reverse order, the states entered
+// are exited without running their callbacks and the active configuration and
+// recorded history are restored. Timers and contexts of the states exited are
+// restored and their activities relaunched with the input they were entered with.
+// Triggers fired from within callbacks during the transition are discarded. Rolling back a dry run only restores the active configuration
+// and recorded history.
+func (sm *StateMachine[T]) rollback(ctx context.Context, input T) {
+	j := &sm.journal
+	j.active = false // Not rolled back again if a compensation panics.
+	sm.entering = nil
+	for i := len(j.ran) - 1; i >= 0; i-- {
+		r := j.ran[i]
+		if sm.onFringe != nil {
+			sm.onFringe(r.tr, *r.fringe.compensation, input)
+		}
+		start := time.Now()
+		r.fringe.compensation.cb(ctx, r.tr, input)
+		if sm.result != nil {
+			sm.recordCallback(r.fringe.compensation.label, r.phase, phaseState(r.phase, r.tr), true, time.Since(start))
+		}
+	}
+	sm.restoreJournal(ctx)
+}
+
+// restoreJournal restores the active configuration, recorded history and trigger
+// queue of sm to those before the transition in progress without running any
+// callbacks. The states entered are stopped and the timers, contexts and
+// activities of the states exited restored.
+func (sm *StateMachine[T]) restoreJournal(ctx context.Context) {
+	j := &sm.journal
+	j.active = false
+	sm.entering = nil
+	for i := len(j.entered) - 1; i >= 0 && !sm.dryRun; i-- {
+		s := j.entered[i]
+		sm.stopState(ctx, s)
+		if len(sm.contexts) > 0 {
+			sm.cancelStateContext(s)
+		}
+	}
+	for i := len(j.history) - 1; i >= 0; i-- {
+		h := j.history[i]
+		if h.prev == nil {
+			delete(sm.history, h.label)
+		} else {
+			sm.history[h.label] = h.prev
+		}
+	}
+	sm.actual = j.actual
+	sm.leaves = append(sm.leaves[:0], j.leaves...)
+	sm.queue = sm.queue[:j.queued]
+	sm.timers = append(sm.timers, j.timers...)
+	sm.contexts = append(sm.contexts, j.contexts...)
+	j.timers, j.contexts = j.timers[:0], j.contexts[:0]
+	for _, ra := range j.activities {
+		sm.launchActivity(ra.state, ra.activity, ra.input)
+	}
+}
+
+// fire performs the transition tr once its guard clauses have been checked.
+// It returns error if transition was unable to be completed in which case the
+// state remains same as before. tr.Src must be an active leaf state. On success
+// the active configuration and the actual state of the state machine are updated.
+// If a callback fails the transition is rolled back and a CallbackError is returned.
+// The journal started by fire must be reset by the caller once the transition completes.
 func (sm *StateMachine[T]) fire(ctx context.Context, tr Transition[T], input T) error {
-	if err := tr.isPermitted(ctx, input); err != nil {
-		return err
+	sm.journal.begin(sm)
+	err := sm.transition(ctx, tr, input)
+	if err != nil {
+		sm.rollback(ctx, input)
+	}
+	return err
+}
+
+// transition runs the callbacks of tr and updates the active configuration.
+func (sm *StateMachine[T]) transition(ctx context.Context, tr Transition[T], input T) error {
+	if tr.internal {
+		return sm.runFringe(ctx, tr, PhaseEffect, tr.effect, input)
 	}
 	if statesEqual(tr.Src, tr.Dst) {
-		sm.reenter(ctx, tr, input)
-		return nil
+		if tr.HasEffect() {
+			if err := sm.runFringe(ctx, tr, PhaseEffect, tr.effect, input); err != nil {
+				return err
+			}
+		}
+		return sm.reenter(ctx, tr, input)
+	}
+	domain := transitionDomain(tr.Src, tr.Dst)
+	at, err := sm.exit(ctx, tr, domain, input)
+	if err != nil {
+		return err
+	}
+	if tr.HasEffect() {
+		if err := sm.runFringe(ctx, tr, PhaseEffect, tr.effect, input); err != nil {
+			return err
+		}
+	}
+	if err := sm.enter(ctx, tr, domain, at, input); err != nil {
+		return err
 	}
-	sm.exit(ctx, tr, input)
-	sm.enter(ctx, tr, input)
+	sm.actual = commonAncestor(sm.leaves)
 	return nil
 }
 
+// containsState returns true if states contains s.
+func containsState[T input](states []*State[T], s *State[T]) bool {
+	for _, state := range states {
+		if statesEqual(state, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// commonAncestor returns the innermost state containing all leaves.
+func commonAncestor[T input](leaves []*State[T]) *State[T] {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	s := leaves[0]
+	for i := 1; i < len(leaves) && s != nil; i++ {
+		for s != nil && !s.Contains(leaves[i]) {
+			s = s.parent
+		}
+	}
+	if s == nil {
+		panic("active states share no common ancestor")
+	}
+	return s
+}
+
 func (s *State[T]) getTransition(t Trigger) *Transition[T] {
 	for i := 0; i < len(s.transitions); i++ {
 		if t == s.transitions[i].Trigger {
@@ -181,6 +844,112 @@ func (s *State[T]) getTransition(t Trigger) *Transition[T] {
 	return nil
 }
 
+// hasAlternatives returns true if the state that registered tr has other
+// transitions registered for the same trigger.
+func (tr *Transition[T]) hasAlternatives() bool {
+	n := 0
+	for i := 0; i < len(tr.Src.transitions) && n < 2; i++ {
+		if tr.Src.transitions[i].Trigger == tr.Trigger {
+			n++
+		}
+	}
+	return n > 1
+}
+
+// selectTransition evaluates the guard clauses of the transitions registered for
+// the trigger of first on the same state, in order of registration, and returns
+// the first transition permitted. If unambiguous is set all transitions are
+// evaluated and an AmbiguousTransitionError is returned if more than one is permitted,
+// the fallback transition with no guard clauses excepted.
+// If no transition is permitted the errors of all guard clauses that failed are returned.
+func (first *Transition[T]) selectTransition(ctx context.Context, input T, unambiguous bool, site *callSite) (*Transition[T], error) {
+	var selected *Transition[T]
+	var errs []error
+	s := first.Src
+	for i := 0; i < len(s.transitions); i++ {
+		tr := &s.transitions[i]
+		if tr.Trigger != first.Trigger {
+			continue
+		} else if selected != nil && len(tr.guards) == 0 {
+			break // Fallback registered last is only taken if no other transition is.
+		}
+		if err := tr.isPermitted(ctx, input, site); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if selected == nil {
+			selected = tr
+			if !unambiguous {
+				break
+			}
+			continue
+		}
+		ambiguous := &AmbiguousTransitionError{State: s.label, Trigger: first.Trigger}
+		for _, permitted := range []*Transition[T]{selected, tr} {
+			ambiguous.Transitions = append(ambiguous.Transitions, permitted.String())
+		}
+		return nil, ambiguous
+	}
+	if selected == nil {
+		return nil, joinErrors(errs)
+	}
+	return selected, nil
+}
+
+// resolveTransition returns the first transition registered for trigger t on s or,
+// if s has none, the first transition registered on its closest ancestor.
+func (s *State[T]) resolveTransition(t Trigger) *Transition[T] {
+	tr, _ := s.resolve(t)
+	return tr
+}
+
+// handling is how a state handles a trigger it has no transition registered for.
+type handling uint8
+
+const (
+	handleNone handling = iota
+	handleIgnore
+	handleDefer
+)
+
+// resolve returns the first transition registered for t found walking up from s
+// or how t is handled if a state ignoring or deferring t is found first.
+func (s *State[T]) resolve(t Trigger) (*Transition[T], handling) {
+	for ; s != nil; s = s.parent {
+		if tr := s.getTransition(t); tr != nil {
+			return tr, handleNone
+		}
+		if h := s.handling(t); h != handleNone {
+			return nil, h
+		}
+	}
+	return nil, handleNone
+}
+
+// forEachTransition calls fn on each transition available from s: its own
+// transitions followed by those inherited from its ancestors that are not
+// overridden by a transition with the same trigger closer to s.
+// Iteration stops if fn returns an error, which is then returned.
+func (s *State[T]) forEachTransition(fn func(tr *Transition[T]) error) error {
+	for state := s; state != nil; state = state.parent {
+		for i := 0; i < len(state.transitions); i++ {
+			tr := &state.transitions[i]
+			if state != s {
+				if tr.Trigger == TriggerDone {
+					continue // Completion transitions are not inherited.
+				}
+				if resolved := s.resolveTransition(tr.Trigger); resolved == nil || resolved.Src != state {
+					continue // Overridden or ignored by a descendant.
+				}
+			}
+			if err := fn(tr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // GuardClauseError is a auxiliary type used to wrap errors returned by guard clauses
 // so that users may check for them specifically after a call to Fire methods on
 // a state machine:
@@ -214,8 +983,271 @@ func (g GuardClauseError) Error() string {
 // Unwrap returns the error encountered by a guard as returned by the GuardClause.
 func (g GuardClauseError) Unwrap() error { return g.err }
 
-func (tr Transition[T]) isPermitted(ctx context.Context, input T) error {
+// ErrUnhandledTrigger is wrapped by UnhandledTriggerError so that users may check
+// for unhandled triggers with errors.Is.
+var ErrUnhandledTrigger = errors.New("unhandled trigger")
+
+// UnhandledTriggerError is returned by Fire methods on a state machine when the
+// fired trigger has no transition registered for the current state:
+//
+//	err := sm.FireBg(trigger, input)
+//	var u *UnhandledTriggerError
+//	if errors.As(err, &u) {
+//		fmt.Println("trigger", u.Trigger, "not handled in state", u.State)
+//	}
+type UnhandledTriggerError struct {
+	// The label of the state in which the trigger was fired.
+	State string
+	// The unhandled trigger.
+	Trigger Trigger
+}
+
+// Error returns a string representation of the unhandled trigger and state label.
+func (u UnhandledTriggerError) Error() string {
+	return "trigger " + u.Trigger.Quote() + " not handled for state \"" + u.State + "\""
+}
+
+// Unwrap returns ErrUnhandledTrigger.
+func (u UnhandledTriggerError) Unwrap() error { return ErrUnhandledTrigger }
+
+// ErrAmbiguousTransition is wrapped by AmbiguousTransitionError so that users may
+// check for ambiguous transitions with errors.Is.
+var ErrAmbiguousTransition = errors.New("ambiguous transition")
+
+// AmbiguousTransitionError is returned by Fire methods on a state machine that
+// rejects ambiguous transitions when more than one of the transitions registered
+// for the fired trigger on a state are permitted. See [StateMachine.RejectAmbiguousTransitions].
+type AmbiguousTransitionError struct {
+	// The label of the state the transitions are registered on.
+	State string
+	// The fired trigger.
+	Trigger Trigger
+	// String representations of the first two transitions found to be permitted.
+	Transitions []string
+}
+
+// Error returns a string representation of the ambiguous transitions.
+func (a AmbiguousTransitionError) Error() string {
+	str := "ambiguous trigger " + a.Trigger.Quote() + " for state \"" + a.State + "\" permits"
+	for i, tr := range a.Transitions {
+		if i > 0 {
+			str += " and"
+		}
+		str += " " + tr
+	}
+	return str
+}
+
+// Unwrap returns ErrAmbiguousTransition.
+func (a AmbiguousTransitionError) Unwrap() error { return ErrAmbiguousTransition }
+
+// ErrAutomaticLoop is wrapped by AutomaticLoopError so that users may check
+// for automatic transition loops with errors.Is.
+var ErrAutomaticLoop = errors.New("automatic transition loop")
+
+// AutomaticLoopError is returned by Fire methods on a state machine when an
+// automatic transition would enter a state already rested in since the fired
+// trigger was handled. The state machine remains in the last state reached.
+// See [State.PermitAutomatic].
+type AutomaticLoopError struct {
+	// Labels of the states rested in, in order, followed by the state that would be re-entered.
+	Path []string
+}
+
+// Error returns a string representation of the automatic transition loop.
+func (a AutomaticLoopError) Error() string {
+	str := "automatic transition loop"
+	for i, label := range a.Path {
+		if i > 0 {
+			str += " ->"
+		}
+		str += " \"" + label + "\""
+	}
+	return str
+}
+
+// Unwrap returns ErrAutomaticLoop.
+func (a AutomaticLoopError) Unwrap() error { return ErrAutomaticLoop }
+
+// QueuedTriggerError wraps the error returned by a trigger that was fired from
+// within a callback during a transition and queued for later processing.
+// It is returned by the Fire call that started the outermost transition.
+type QueuedTriggerError struct {
+	// The queued trigger.
+	Trigger Trigger
+	// The error as returned when the trigger was fired.
+	err error
+}
+
+// Error returns a string representation of the queued trigger and its error.
+func (q QueuedTriggerError) Error() string {
+	return "queued trigger " + q.Trigger.Quote() + ": " + q.err.Error()
+}
+
+// Unwrap returns the error encountered when firing the queued trigger.
+func (q QueuedTriggerError) Unwrap() error { return q.err }
+
+// Phase is the step of a transition in which a callback is run.
+type Phase uint8
+
+const (
+	// PhaseGuard is the step in which guard clauses and destination selectors
+	// are evaluated to select the transition and its destination.
+	PhaseGuard Phase = iota
+	// PhaseTransitioning is the step in which the OnTransitioning callback is run.
+	PhaseTransitioning
+	// PhaseExit is the step in which exit callbacks of the states left are run.
+	PhaseExit
+	// PhaseEffect is the step in which the effect of a transition, or the action
+	// of an internal transition, is run.
+	PhaseEffect
+	// PhaseEntry is the step in which entry callbacks of the states entered are run.
+	PhaseEntry
+	// PhaseReentry is the step in which reentry callbacks are run.
+	PhaseReentry
+	// PhaseTransitioned is the step in which the OnTransitioned and OnDone callbacks are run.
+	PhaseTransitioned
+	// PhaseUnhandled is the step in which the OnUnhandledTrigger callback is run.
+	PhaseUnhandled
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseGuard:
+		return "guard"
+	case PhaseTransitioning:
+		return "transitioning"
+	case PhaseTransitioned:
+		return "transitioned"
+	case PhaseUnhandled:
+		return "unhandled trigger"
+	case PhaseExit:
+		return "exit"
+	case PhaseEffect:
+		return "effect"
+	case PhaseEntry:
+		return "entry"
+	case PhaseReentry:
+		return "reentry"
+	}
+	return "invalid phase"
+}
+
+// phaseState returns the state the callbacks run during phase p of tr are registered on.
+func phaseState[T input](p Phase, tr Transition[T]) *State[T] {
+	if p == PhaseEntry || p == PhaseReentry {
+		return tr.Dst
+	}
+	return tr.Src
+}
+
+// CallbackError is returned by Fire methods on a state machine when a fallible
+// callback fails during a transition, which is then rolled back. It implements
+// Unwrap so that users may check for the error returned by the callback:
+//
+//	err := sm.FireBg(trigger, input)
+//	var cbErr *CallbackError
+//	if errors.As(err, &cbErr) {
+//		fmt.Println(cbErr.Phase, "callback", cbErr.Label, "failed:", cbErr.Unwrap())
+//	}
+//
+// See [NewFallibleCallback].
+type CallbackError struct {
+	// The label of the callback that failed.
+	Label string
+	// The step of the transition in which the callback failed.
+	Phase Phase
+	// The label of the state the callback is registered on. For effects it is
+	// the label of the source state of the transition.
+	State string
+	// The fired trigger.
+	Trigger Trigger
+	// The error as returned by the callback.
+	err error
+}
+
+// Error returns a string representation of the failed callback and its error.
+func (c CallbackError) Error() string {
+	return c.Phase.String() + " callback \"" + c.Label + "\" of state \"" + c.State + "\" failed on trigger " + c.Trigger.Quote() + ": " + c.err.Error()
+}
+
+// Unwrap returns the error as returned by the callback.
+func (c CallbackError) Unwrap() error { return c.err }
+
+// PanicError is returned by Fire methods on a state machine when a guard clause or
+// callback panics and the panic is recovered according to the panic policy of the
+// state machine. See [StateMachine.SetPanicPolicy].
+type PanicError struct {
+	// The label of the guard clause or callback that panicked. It is empty for
+	// the OnUnhandledTrigger callback.
+	Label string
+	// The step of the transition in which the panic occurred.
+	Phase Phase
+	// The fired trigger.
+	Trigger Trigger
+	// The value passed to panic.
+	Value any
+	// The stack trace of the goroutine that panicked as formatted by debug.Stack.
+	Stack []byte
+}
+
+// Error returns a string representation of the panic and where it occurred.
+func (p PanicError) Error() string {
+	str := "panic in " + p.Phase.String()
+	if p.Label != "" {
+		str += " \"" + p.Label + "\""
+	}
+	return str + " on trigger " + p.Trigger.Quote() + ": " + fmt.Sprint(p.Value)
+}
+
+// Unwrap returns the value passed to panic if it is an error, such as a
+// runtime.Error, or nil otherwise.
+func (p PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// callSite identifies the guard clause or callback being run by a state machine.
+type callSite struct {
+	phase Phase
+	label string
+}
+
+// joinError is a minimal implementation of the error returned by errors.Join
+// so that go-maquina may be used with Go versions prior to 1.20.
+type joinError struct {
+	errs []error
+}
+
+// joinErrors returns nil if errs is empty and the error itself if errs contains
+// a single error. Otherwise it returns an error wrapping all errors in errs.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return &joinError{errs: errs}
+}
+
+func (e *joinError) Error() string {
+	str := e.errs[0].Error()
+	for _, err := range e.errs[1:] {
+		str += "\n" + err.Error()
+	}
+	return str
+}
+
+func (e *joinError) Unwrap() []error { return e.errs }
+
+// isPermitted evaluates the guard clauses of tr in order. If site is not nil
+// it is set to the guard clause being evaluated.
+func (tr Transition[T]) isPermitted(ctx context.Context, input T, site *callSite) error {
 	for i := 0; i < len(tr.guards); i++ {
+		if site != nil {
+			*site = callSite{phase: PhaseGuard, label: tr.guards[i].label}
+		}
 		if err := tr.guards[i].guard(ctx, input); err != nil {
 			return &GuardClauseError{err: err, Label: tr.guards[i].label}
 		}
@@ -227,17 +1259,48 @@ func (tr Transition[T]) isPermitted(ctx context.Context, input T) error {
 	return nil
 }
 
+// guardErrors evaluates all guard clauses of tr and returns the errors of those
+// that fail, followed by the context's error if it is done.
+func (tr Transition[T]) guardErrors(ctx context.Context, input T) (errs []error) {
+	for i := 0; i < len(tr.guards); i++ {
+		if err := tr.guards[i].guard(ctx, input); err != nil {
+			errs = append(errs, &GuardClauseError{err: err, Label: tr.guards[i].label})
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
 // String returns a basic text-arrow representation of the transition.
 func (tr Transition[T]) String() string {
-	str := tr.Src.label + " --" + tr.Trigger.String() + "-> " + tr.Dst.label
+	var dst string
+	if tr.Dst != nil {
+		dst = tr.Dst.label
+	} else {
+		// Dynamic transition with no destination selected yet.
+		for i, possible := range tr.selector.dsts {
+			if i > 0 {
+				dst += "|"
+			}
+			dst += possible.label
+		}
+		dst += " (" + tr.selector.label + ")"
+	}
+	str := tr.Src.label + " --" + tr.Trigger.String() + "-> " + dst
 	for i := 0; i < len(tr.guards); i++ {
 		str += " [" + tr.guards[i].String() + "]"
 	}
+	if tr.HasEffect() {
+		str += " / " + tr.effect.label
+	}
 	return str
 }
 
 // WalkStates recurses down the state tree in a depth first search for
 // all unique states in what would be a state machine starting with the argument state.
+// Transitions inherited from superstates, initial substates and orthogonal regions are followed.
 // It calls fn on every new state it finds. If fn returns an error, the walk is aborted
 // and the error is returned.
 //
@@ -263,16 +1326,51 @@ func walkStatesInternal[T input](src *State[T], fn func(s *State[T]) error, visi
 		if !statesEqual(src, src.transitions[i].Src) {
 			panic("state's transition source \"" + src.String() + "\" not match transition source: " + src.transitions[i].String())
 		}
-		dst := src.transitions[i].Dst
+	}
+	// Transitions inherited from superstates are walked as well.
+	visit := func(dst *State[T]) error {
+		if dst.resumes != HistoryNone {
+			dst = dst.parent // History pseudo-states enter their superstate.
+		}
 		if _, ok := visited[dst.label]; ok {
-			continue // Already visited.
+			return nil // Already visited.
 		}
 		visited[dst.label] = struct{}{} // Mark as visited.
-		err := fn(dst)
-		if err != nil {
+		toVisit = append(toVisit, dst)
+		return fn(dst)
+	}
+	if src.initial != nil {
+		// Entering src descends into its initial substate.
+		if err := visit(src.initial); err != nil {
 			return err
 		}
-		toVisit = append(toVisit, dst)
+	}
+	for _, region := range src.regions {
+		// Entering src enters all its orthogonal regions.
+		if err := visit(region); err != nil {
+			return err
+		}
+	}
+	for _, tr := range src.automatic {
+		if err := visit(tr.Dst); err != nil {
+			return err
+		}
+	}
+	for _, tr := range src.branches {
+		if err := visit(tr.Dst); err != nil {
+			return err
+		}
+	}
+	err := src.forEachTransition(func(tr *Transition[T]) error {
+		for _, dst := range tr.destinations() {
+			if err := visit(dst); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	for i := 0; i < len(toVisit); i++ {
 		if err := walkStatesInternal(toVisit[i], fn, visited); err != nil {
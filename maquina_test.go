@@ -8,8 +8,12 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type intTransition = Transition[int]
@@ -26,7 +30,23 @@ func TestStateMachine_OnUnhandledTrigger(t *testing.T) {
 	}
 	sm.OnUnhandledTrigger(nil)
 
+	t.Run("default error", func(t *testing.T) {
+		err := sm.FireBg("unhandled trigger with error", 1)
+		var u *UnhandledTriggerError
+		if !errors.As(err, &u) {
+			t.Fatalf("expected unhandled trigger error, got %v", err)
+		}
+		if u.State != "start" || u.Trigger != "unhandled trigger with error" {
+			t.Errorf("unexpected unhandled trigger error contents: %+v", u)
+		}
+		if !errors.Is(err, ErrUnhandledTrigger) {
+			t.Error("expected error to wrap ErrUnhandledTrigger")
+		}
+	})
+
 	t.Run("catch panic", func(t *testing.T) {
+		sm.PanicOnUnhandledTrigger(true)
+		defer sm.PanicOnUnhandledTrigger(false)
 		defer func() {
 			a := recover()
 			if a == nil {
@@ -279,6 +299,136 @@ func TestGuardClauseError(t *testing.T) {
 	}
 }
 
+func TestSyncStateMachine_stress(t *testing.T) {
+	const (
+		numStates  = 8
+		numFirers  = 8
+		numReaders = 4
+		numFires   = 500
+		numReads   = 500
+	)
+	states := hyperStates(numStates)
+	var transitioning bool
+	var transitions, exits, entries int
+	for i := range states {
+		states[i].OnExit(NewFringeCallback("exit", func(_ context.Context, _ intTransition, _ int) {
+			exits++
+		}))
+		states[i].OnEntry(NewFringeCallback("entry", func(_ context.Context, _ intTransition, _ int) {
+			entries++
+		}))
+	}
+	sm := NewStateMachine(states[0])
+	sm.OnUnhandledTrigger(func(current *State[int], t Trigger) error { return nil })
+	sm.OnTransitioning(NewFringeCallback("start", func(_ context.Context, _ intTransition, _ int) {
+		if transitioning {
+			t.Error("transition started before previous one completed")
+		}
+		transitioning = true
+	}))
+	sm.OnTransitioned(NewFringeCallback("end", func(_ context.Context, _ intTransition, _ int) {
+		transitioning = false
+		transitions++
+	}))
+	ssm := NewSyncStateMachine(sm)
+	var wg sync.WaitGroup
+	for i := 0; i < numFirers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for j := 0; j < numFires; j++ {
+				avail := ssm.TriggersAvailable()
+				err := ssm.FireBg(avail[rng.Intn(len(avail))], j)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(int64(i))
+	}
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numReads; j++ {
+				if ssm.State() == nil || ssm.StateLabel() == "" {
+					t.Error("invalid state")
+				}
+				ssm.TriggersPermitted(context.Background(), 1)
+				ssm.StateIsSink()
+				if len(ssm.Configuration()) != 1 || ssm.Snapshot().State == "" {
+					t.Error("invalid configuration")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ssm.Restore(ssm.Snapshot()); err != nil {
+		t.Error(err)
+	}
+	if transitions == 0 {
+		t.Fatal("expected transitions to occur")
+	}
+	if exits != transitions || entries != transitions {
+		t.Errorf("expected %d exits and entries, got %d exits and %d entries", transitions, exits, entries)
+	}
+}
+
+func TestFireFromCallback(t *testing.T) {
+	const (
+		trigQuote   Trigger = "quote received"
+		trigExecute Trigger = "execute"
+		trigFail    Trigger = "fail"
+	)
+	var (
+		waiting   = NewState("waiting on quote", 1)
+		ready     = NewState("ready to operate", 1)
+		executing = NewState("executing", 1)
+		guardErr  = errors.New("guard error")
+		order     []string
+	)
+	sm := NewStateMachine(waiting)
+	waiting.Permit(trigQuote, ready)
+	ready.Permit(trigExecute, executing)
+	executing.Permit(trigFail, ready, NewGuard("fail", func(_ context.Context, _ int) error {
+		return guardErr
+	}))
+	ready.OnEntry(NewFringeCallback("auto execute", func(ctx context.Context, tr intTransition, input int) {
+		order = append(order, "enter ready")
+		if err := sm.Fire(ctx, trigExecute, input); err != nil {
+			t.Error("queued fire should not return error:", err)
+		}
+		if sm.State() != waiting {
+			t.Error("state should not change during transition")
+		}
+	}))
+	executing.OnEntry(NewFringeCallback("fail", func(ctx context.Context, tr intTransition, input int) {
+		order = append(order, "enter executing")
+		sm.Fire(ctx, trigFail, input)
+	}))
+	sm.OnTransitioned(NewFringeCallback("log", func(_ context.Context, tr intTransition, _ int) {
+		order = append(order, "transitioned "+tr.Trigger.String())
+	}))
+	err := sm.FireBg(trigQuote, 1)
+	var qerr *QueuedTriggerError
+	if !errors.As(err, &qerr) || qerr.Trigger != trigFail {
+		t.Errorf("expected queued trigger error for %s, got %v", trigFail, err)
+	}
+	if !errors.Is(err, guardErr) {
+		t.Errorf("expected guard error, got %v", err)
+	}
+	if sm.State() != executing {
+		t.Errorf("expected state %s, got %s", executing.Label(), sm.StateLabel())
+	}
+	expect := []string{"enter ready", "transitioned quote received", "enter executing", "transitioned execute"}
+	if fmt.Sprint(order) != fmt.Sprint(expect) {
+		t.Errorf("expected callback order %v, got %v", expect, order)
+	}
+	if sm.firing || len(sm.queue) != 0 {
+		t.Error("expected state machine to finish firing")
+	}
+}
+
 func hyperTrig(start, end int) Trigger {
 	return Trigger("T" + strconv.Itoa(start) + "→" + strconv.Itoa(end))
 }
@@ -344,10 +494,131 @@ func TestMustPanics(t *testing.T) {
 			desc: "nil state machine state",
 			fn:   func() { NewStateMachine(nilState) },
 		},
+		{
+			desc: "history pseudo-state state machine",
+			fn:   func() { NewStateMachine(okState.ShallowHistory()) },
+		},
+		{
+			desc: "history of history pseudo-state",
+			fn:   func() { okState.ShallowHistory().DeepHistory() },
+		},
 		{
 			desc: "nil on exit callback",
 			fn:   func() { NewState("ok", 1).OnExit(nilFringe) },
 		},
+		{
+			desc: "ignore trigger with transition",
+			fn: func() {
+				s := NewState("ok", 1)
+				s.Permit("ok", okState)
+				s.Ignore("ok")
+			},
+		},
+		{
+			desc: "permit ignored trigger",
+			fn: func() {
+				s := NewState("ok", 1)
+				s.Ignore("ok")
+				s.Permit("ok", okState)
+			},
+		},
+		{
+			desc: "defer ignored trigger",
+			fn: func() {
+				s := NewState("ok", 1)
+				s.Ignore("ok")
+				s.Defer("ok")
+			},
+		},
+		{
+			desc: "permit automatic trigger",
+			fn:   func() { NewState("ok", 1).Permit(TriggerAutomatic, okState) },
+		},
+		{
+			desc: "fire automatic trigger",
+			fn:   func() { NewStateMachine(okState).FireBg(TriggerAutomatic, 1) },
+		},
+		{
+			desc: "branch after else branch",
+			fn: func() {
+				c := NewChoice("ok", 1)
+				c.Branch(okState)
+				c.Branch(okState)
+			},
+		},
+		{
+			desc: "permit on choice",
+			fn:   func() { NewChoice("ok", 1).Permit("ok", okState) },
+		},
+		{
+			desc: "choice initial state",
+			fn:   func() { NewStateMachine(NewChoice("ok", 1)) },
+		},
+		{
+			desc: "permit on final state",
+			fn: func() {
+				s := NewState("ok", 1)
+				s.SetFinal()
+				s.Permit("ok", okState)
+			},
+		},
+		{
+			desc: "fire done trigger",
+			fn:   func() { NewStateMachine(okState).FireBg(TriggerDone, 1) },
+		},
+		{
+			desc: "nil activity",
+			fn:   func() { NewState("ok", 1).Do(Activity[int]{}, "") },
+		},
+		{
+			desc: "timer firing done trigger",
+			fn:   func() { NewState("ok", 1).After(time.Second, TriggerDone) },
+		},
+		{
+			desc: "activity failing with fault trigger",
+			fn: func() {
+				NewState("ok", 1).Do(NewActivity("ok", func(context.Context, int) error { return nil }), TriggerFault)
+			},
+		},
+		{
+			desc: "state machine within state with timers",
+			fn: func() {
+				super, sub := NewState("super", 1), NewState("sub", 1)
+				super.LinkSubstates(sub)
+				super.After(time.Second, "timeout")
+				NewStateMachine(sub)
+			},
+		},
+		{
+			desc: "fire fault trigger",
+			fn:   func() { NewStateMachine(okState).FireBg(TriggerFault, 1) },
+		},
+		{
+			desc: "permit fault trigger",
+			fn:   func() { NewState("ok", 1).Permit(TriggerFault, okState) },
+		},
+		{
+			desc: "fault panic policy without fault state",
+			fn:   func() { NewStateMachine(okState).SetPanicPolicy(PanicFault, nil) },
+		},
+		{
+			desc: "guard combinator without operands",
+			fn:   func() { All[int]() },
+		},
+		{
+			desc: "nil compensation",
+			fn: func() {
+				NewFringeCallback("ok", func(context.Context, intTransition, int) {}).WithCompensation(nilFringe)
+			},
+		},
+		{
+			desc: "nil transition effect",
+			fn:   func() { NewState("ok", 1).PermitWithEffect("ok", okState, nilFringe) },
+		},
+		{
+			desc: "nil internal transition action",
+			fn:   func() { NewState("ok", 1).InternalTransition("ok", nilFringe) },
+		},
 		{
 			desc: "nil on entry callback",
 			fn:   func() { NewState("ok", 1).OnEntry(nilFringe) },
@@ -372,6 +643,14 @@ func TestMustPanics(t *testing.T) {
 			desc: "empty trigger",
 			fn:   func() { NewState("ok", 1).Permit("", NewState("notok", 2)) },
 		},
+		{
+			desc: "trigger registered after unguarded transition",
+			fn: func() {
+				s := NewState("ok", 1)
+				s.Permit("trig1", s)
+				s.Permit("trig1", s, NewGuard("ok", func(_ context.Context, _ int) error { return nil }))
+			},
+		},
 		{
 			desc: "trigger registered twice in state",
 			fn: func() {
@@ -380,6 +659,16 @@ func TestMustPanics(t *testing.T) {
 				s.Permit("trig1", s)
 			},
 		},
+		{
+			desc: "destination selector without destinations",
+			fn: func() {
+				NewDestinationSelector("sel", func(_ context.Context, _ int) *State[int] { return okState })
+			},
+		},
+		{
+			desc: "zero value destination selector",
+			fn:   func() { NewState("ok", 1).PermitDynamic("ok", DestinationSelector[int]{}) },
+		},
 		{
 			desc: "nil destination state in always permit",
 			fn:   func() { NewStateMachine(okState).AlwaysPermit("ok", nil) },
@@ -578,7 +867,1965 @@ func TestSuperstateFringe(t *testing.T) {
 	}
 }
 
-func ExampleMermaid() {
+func TestInheritedTransitions(t *testing.T) {
+	const (
+		trigStart  Trigger = "start"
+		trigNext   Trigger = "next"
+		trigCancel Trigger = "cancel"
+	)
+	var (
+		idle      = NewState("idle", 1)
+		waiting   = NewState("waiting", 1)
+		executing = NewState("executing", 1)
+		critical  = NewState("critical section", 1)
+		exited    []string
+	)
+	idle.Permit(trigStart, waiting)
+	waiting.Permit(trigNext, executing)
+	waiting.Permit(trigCancel, waiting) // Overrides superstate transition.
+	critical.Permit(trigCancel, idle)
+	err := critical.LinkSubstates(waiting, executing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*State[int]{waiting, executing, critical} {
+		label := s.Label()
+		s.OnExit(NewFringeCallback("exit", func(_ context.Context, tr intTransition, _ int) {
+			exited = append(exited, label)
+			if tr.Src.Label() != label {
+				t.Errorf("expected exit transition source %s, got %s", label, tr.Src.Label())
+			}
+		}))
+	}
+	sm := NewStateMachine(idle)
+	var buf bytes.Buffer
+	_, err = WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"executing" -> "idle" [ label = "cancel", style = "solid", color = gray ];`)) {
+		t.Errorf("expected inherited transition in DOT output:\n%s", buf.String())
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`"waiting" -> "idle"`)) {
+		t.Errorf("did not expect overridden transition in DOT output:\n%s", buf.String())
+	}
+	mustFire := func(trig Trigger, expect *State[int]) {
+		t.Helper()
+		if err := sm.FireBg(trig, 1); err != nil {
+			t.Fatal(err)
+		}
+		if sm.State() != expect {
+			t.Fatalf("expected state %s, got %s", expect.Label(), sm.StateLabel())
+		}
+	}
+	mustFire(trigStart, waiting)
+	mustFire(trigCancel, waiting)
+	mustFire(trigNext, executing)
+	avail := sm.TriggersAvailable()
+	if len(avail) != 1 || avail[0] != trigCancel {
+		t.Errorf("expected inherited trigger available, got %v", avail)
+	}
+	permitted := sm.TriggersPermitted(context.Background(), 1)
+	if len(permitted) != 1 || permitted[0] != trigCancel {
+		t.Errorf("expected inherited trigger permitted, got %v", permitted)
+	}
+	if sm.StateIsSink() {
+		t.Error("state with inherited transitions is not a sink")
+	}
+	exited = exited[:0]
+	mustFire(trigCancel, idle)
+	expect := []string{"executing", "critical section"}
+	if fmt.Sprint(exited) != fmt.Sprint(expect) {
+		t.Errorf("expected exit order %v, got %v", expect, exited)
+	}
+}
+
+func TestInitialSubstate(t *testing.T) {
+	const (
+		trigEnter Trigger = "enter"
+		trigReset Trigger = "reset"
+		trigNext  Trigger = "next"
+	)
+	var (
+		idle   = NewState("idle", 1)
+		outer  = NewState("outer", 1)
+		middle = NewState("middle", 1)
+		leaf   = NewState("leaf", 1)
+		other  = NewState("other", 1)
+		log    []string
+	)
+	if err := outer.LinkSubstates(middle); err != nil {
+		t.Fatal(err)
+	}
+	if err := middle.LinkSubstates(leaf, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := outer.SetInitialSubstate(leaf); err == nil {
+		t.Error("expected error setting non-direct substate as initial")
+	}
+	if err := outer.SetInitialSubstate(middle); err != nil {
+		t.Fatal(err)
+	}
+	if err := middle.SetInitialSubstate(leaf); err != nil {
+		t.Fatal(err)
+	}
+	idle.Permit(trigEnter, outer)
+	leaf.Permit(trigNext, other)
+	middle.Permit(trigReset, middle)
+	for _, s := range []*State[int]{outer, middle, leaf, other} {
+		label := s.Label()
+		s.OnEntry(NewFringeCallback("entry", func(_ context.Context, tr intTransition, _ int) {
+			log = append(log, "enter "+label)
+		}))
+		s.OnExit(NewFringeCallback("exit", func(_ context.Context, tr intTransition, _ int) {
+			log = append(log, "exit "+label)
+		}))
+	}
+	sm := NewStateMachine(idle)
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`_initial -> "leaf";`)) || !bytes.Contains(buf.Bytes(), []byte(`_initial -> "middle";`)) {
+		t.Errorf("expected initial substates marked in DOT output:\n%s", buf.String())
+	}
+	for _, test := range []struct {
+		trigger Trigger
+		expect  *State[int]
+		log     []string
+	}{
+		{trigger: trigEnter, expect: leaf, log: []string{"enter outer", "enter middle", "enter leaf"}},
+		{trigger: trigNext, expect: other, log: []string{"exit leaf", "enter other"}},
+		// Transition to superstate from substate descends into initial substate.
+		{trigger: trigReset, expect: leaf, log: []string{"exit other", "enter leaf"}},
+	} {
+		log = log[:0]
+		err := sm.FireBg(test.trigger, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sm.State() != test.expect {
+			t.Errorf("%s: expected state %s, got %s", test.trigger, test.expect.Label(), sm.StateLabel())
+		}
+		if fmt.Sprint(log) != fmt.Sprint(test.log) {
+			t.Errorf("%s: expected callbacks %v, got %v", test.trigger, test.log, log)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	const (
+		trigResume Trigger = "resume"
+		trigPause  Trigger = "pause"
+		trigNext   Trigger = "next"
+	)
+	for _, test := range []struct {
+		history History
+		expect  string // Expected state after resuming.
+	}{
+		{history: HistoryNone, expect: "waiting"},
+		{history: HistoryShallow, expect: "ready"}, // Resumes in operating and descends into its initial substate.
+		{history: HistoryDeep, expect: "executing"},
+	} {
+		var (
+			paused    = NewState("paused", 1)
+			critical  = NewState("critical section", 1)
+			waiting   = NewState("waiting", 1)
+			operating = NewState("operating", 1)
+			ready     = NewState("ready", 1)
+			executing = NewState("executing", 1)
+			entered   []string
+		)
+		critical.LinkSubstates(waiting, operating)
+		operating.LinkSubstates(ready, executing)
+		critical.SetInitialSubstate(waiting)
+		operating.SetInitialSubstate(ready)
+		critical.SetHistory(test.history)
+		paused.Permit(trigResume, critical)
+		critical.Permit(trigPause, paused)
+		waiting.Permit(trigNext, operating)
+		ready.Permit(trigNext, executing)
+		for _, s := range []*State[int]{critical, waiting, operating, ready, executing} {
+			label := s.Label()
+			s.OnEntry(NewFringeCallback("entry", func(_ context.Context, _ intTransition, _ int) {
+				entered = append(entered, label)
+			}))
+		}
+		sm := NewStateMachine(paused)
+		for _, trig := range []Trigger{trigResume, trigNext, trigNext, trigPause} {
+			if err := sm.FireBg(trig, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		recorded := sm.History(critical)
+		switch {
+		case test.history == HistoryNone && recorded != nil:
+			t.Errorf("expected no history recorded, got %s", recorded.Label())
+		case test.history == HistoryShallow && recorded != operating:
+			t.Errorf("expected shallow history %s, got %v", operating.Label(), recorded)
+		case test.history == HistoryDeep && recorded != executing:
+			t.Errorf("expected deep history %s, got %v", executing.Label(), recorded)
+		}
+		snap := sm.Snapshot()
+		entered = entered[:0]
+		if err := sm.FireBg(trigResume, 1); err != nil {
+			t.Fatal(err)
+		}
+		expectState := test.expect
+		if sm.StateLabel() != expectState {
+			t.Errorf("history %d: expected to resume in %s, got %s", test.history, expectState, sm.StateLabel())
+		}
+		if entered[len(entered)-1] != expectState || (test.history != HistoryNone && entered[1] != "operating") {
+			t.Errorf("history %d: unexpected entry callbacks %v", test.history, entered)
+		}
+
+		// Restoring the snapshot into a fresh state machine preserves history.
+		restored := NewStateMachine(paused)
+		if err := restored.Restore(snap); err != nil {
+			t.Fatal(err)
+		}
+		if restored.History(critical) != recorded || restored.State() != paused {
+			t.Errorf("history %d: snapshot not restored correctly: %+v", test.history, snap)
+		}
+		if err := restored.FireBg(trigResume, 1); err != nil {
+			t.Fatal(err)
+		}
+		if restored.StateLabel() != expectState {
+			t.Errorf("history %d: expected restored machine to resume in %s, got %s", test.history, expectState, restored.StateLabel())
+		}
+	}
+	sm := NewStateMachine(NewState("lonely", 1))
+	if err := sm.Restore(Snapshot{State: "missing"}); err == nil {
+		t.Error("expected error restoring snapshot with unknown state")
+	}
+}
+
+func TestHistoryPseudoStates(t *testing.T) {
+	const (
+		trigRestart    Trigger = "restart"
+		trigResume     Trigger = "resume"
+		trigResumeDeep Trigger = "resume deep"
+		trigPause      Trigger = "pause"
+		trigNext       Trigger = "next"
+	)
+	var (
+		paused    = NewState("paused", 1)
+		critical  = NewState("critical section", 1)
+		waiting   = NewState("waiting", 1)
+		operating = NewState("operating", 1)
+		ready     = NewState("ready", 1)
+		executing = NewState("executing", 1)
+	)
+	critical.LinkSubstates(waiting, operating)
+	operating.LinkSubstates(ready, executing)
+	critical.SetInitialSubstate(waiting)
+	operating.SetInitialSubstate(ready)
+	if critical.ShallowHistory() != critical.ShallowHistory() || critical.DeepHistory() == critical.ShallowHistory() {
+		t.Fatal("expected one pseudo-state per history kind")
+	}
+	if err := critical.SetInitialSubstate(critical.DeepHistory()); err == nil {
+		t.Fatal("expected error setting history pseudo-state as initial substate")
+	}
+	paused.Permit(trigRestart, critical)
+	paused.Permit(trigResume, critical.ShallowHistory())
+	paused.Permit(trigResumeDeep, critical.DeepHistory())
+	critical.Permit(trigPause, paused)
+	waiting.Permit(trigNext, operating)
+	ready.Permit(trigNext, executing)
+	sm := NewStateMachine(paused)
+	for _, step := range []struct {
+		trigger Trigger
+		expect  string
+	}{
+		{trigger: trigResume, expect: "waiting"}, // No history recorded yet.
+		{trigger: trigNext, expect: "ready"},
+		{trigger: trigNext, expect: "executing"},
+		{trigger: trigPause, expect: "paused"},
+		{trigger: trigRestart, expect: "waiting"}, // Plain transitions ignore history.
+		{trigger: trigNext, expect: "ready"},
+		{trigger: trigNext, expect: "executing"},
+		{trigger: trigPause, expect: "paused"},
+		{trigger: trigResume, expect: "ready"},
+		{trigger: trigNext, expect: "executing"},
+		{trigger: trigPause, expect: "paused"},
+		{trigger: trigResumeDeep, expect: "executing"},
+	} {
+		if err := sm.FireBg(step.trigger, 1); err != nil {
+			t.Fatal(err)
+		}
+		if sm.StateLabel() != step.expect {
+			t.Fatalf("after %s: expected %s, got %s", step.trigger, step.expect, sm.StateLabel())
+		}
+	}
+	var b strings.Builder
+	if _, err := WriteDOT(&b, sm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `"critical section (H*)" [ shape = circle, label = "H*" ]`) {
+		t.Errorf("expected deep history pseudo-state in DOT output:\n%s", b.String())
+	}
+}
+
+func TestDeepHistoryRegions(t *testing.T) {
+	const (
+		trigResume Trigger = "resume"
+		trigPause  Trigger = "pause"
+		trigStart  Trigger = "start"
+		trigNext   Trigger = "next"
+	)
+	var (
+		idle  = NewState("idle", 1)
+		p     = NewState("p", 1)
+		setup = NewState("setup", 1)
+		par   = NewState("par", 1)
+		r1    = NewState("r1", 1)
+		r1a   = NewState("r1a", 1)
+		r1b   = NewState("r1b", 1)
+		r2    = NewState("r2", 1)
+		r2a   = NewState("r2a", 1)
+		r2b   = NewState("r2b", 1)
+	)
+	p.LinkSubstates(setup, par)
+	p.SetInitialSubstate(setup)
+	p.SetHistory(HistoryDeep)
+	if err := par.LinkRegions(r1, r2); err != nil {
+		t.Fatal(err)
+	}
+	r1.LinkSubstates(r1a, r1b)
+	r1.SetInitialSubstate(r1a)
+	r2.LinkSubstates(r2a, r2b)
+	r2.SetInitialSubstate(r2a)
+	idle.Permit(trigResume, p)
+	p.Permit(trigPause, idle)
+	setup.Permit(trigStart, par)
+	r1a.Permit(trigNext, r1b)
+	expectConfig := func(sm *StateMachine[int], expect string) {
+		t.Helper()
+		if got := fmt.Sprint(labels(sm.Configuration())); got != expect || sm.State() != par {
+			t.Errorf("expected configuration %s in par, got %s in %s", expect, got, sm.StateLabel())
+		}
+	}
+	sm := NewStateMachine(idle)
+	for _, trig := range []Trigger{trigResume, trigStart, trigNext, trigPause} {
+		if err := sm.FireBg(trig, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sm.History(p) != par || fmt.Sprint(labels(sm.HistoryConfiguration(p))) != "[r1b r2a]" {
+		t.Errorf("expected deep history of both regions, got %v %v", sm.History(p), labels(sm.HistoryConfiguration(p)))
+	}
+	snap := sm.Snapshot()
+	if err := sm.FireBg(trigResume, 1); err != nil {
+		t.Fatal(err)
+	}
+	expectConfig(sm, "[r1b r2a]")
+
+	restored := NewStateMachine(idle)
+	if err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.FireBg(trigResume, 1); err != nil {
+		t.Fatal(err)
+	}
+	expectConfig(restored, "[r1b r2a]")
+	snap.HistoryConfiguration["p"] = []string{"r1b", "idle"}
+	if err := restored.Restore(snap); err == nil {
+		t.Error("expected error restoring history configuration outside of superstate")
+	}
+}
+
+func TestOrthogonalRegions(t *testing.T) {
+	const (
+		trigPowerOn  Trigger = "power on"
+		trigPowerOff Trigger = "power off"
+		trigHeat     Trigger = "heat"
+		trigMove     Trigger = "move"
+		trigTick     Trigger = "tick"
+		trigJam      Trigger = "jam"
+	)
+	var (
+		off      = NewState("off", 1)
+		jammed   = NewState("jammed", 1)
+		printing = NewState("printing", 1)
+		heater   = NewState("heater", 1)
+		cold     = NewState("cold", 1)
+		heating  = NewState("heating", 1)
+		hot      = NewState("hot", 1)
+		motion   = NewState("motion", 1)
+		still    = NewState("still", 1)
+		moving   = NewState("moving", 1)
+		log      []string
+	)
+	mustNil := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustNil(printing.LinkRegions(heater, motion))
+	mustNil(heater.LinkSubstates(cold, heating, hot))
+	mustNil(motion.LinkSubstates(still, moving))
+	mustNil(heater.SetInitialSubstate(cold))
+	mustNil(motion.SetInitialSubstate(still))
+	if printing.LinkSubstates(NewState("stray", 1)) == nil {
+		t.Error("expected error linking substate to state with regions")
+	}
+	off.Permit(trigPowerOn, printing)
+	printing.Permit(trigPowerOff, off)
+	cold.Permit(trigHeat, heating)
+	heating.Permit(trigTick, hot)
+	still.Permit(trigMove, moving)
+	moving.Permit(trigTick, still)
+	moving.Permit(trigJam, jammed)
+	for _, s := range []*State[int]{printing, heater, cold, heating, hot, motion, still, moving} {
+		label := s.Label()
+		s.OnEntry(NewFringeCallback("entry", func(_ context.Context, _ intTransition, _ int) {
+			log = append(log, "enter "+label)
+		}))
+		s.OnExit(NewFringeCallback("exit", func(_ context.Context, _ intTransition, _ int) {
+			log = append(log, "exit "+label)
+		}))
+	}
+	sm := NewStateMachine(off)
+	for _, test := range []struct {
+		trigger Trigger
+		state   *State[int]
+		config  []*State[int]
+		log     []string
+		avail   int
+	}{
+		{
+			trigger: trigPowerOn, state: printing, config: []*State[int]{cold, still},
+			log: []string{"enter printing", "enter heater", "enter cold", "enter motion", "enter still"},
+		},
+		{trigger: trigHeat, state: printing, config: []*State[int]{heating, still}, log: []string{"exit cold", "enter heating"}},
+		{
+			// Triggers of all regions available.
+			trigger: trigMove, state: printing, config: []*State[int]{heating, moving}, avail: 3,
+			log: []string{"exit still", "enter moving"},
+		},
+		{
+			// Dispatched to both regions.
+			trigger: trigTick, state: printing, config: []*State[int]{hot, still},
+			log: []string{"exit heating", "enter hot", "exit moving", "enter still"},
+		},
+		{
+			trigger: trigPowerOff, state: off, config: []*State[int]{off},
+			log: []string{"exit hot", "exit heater", "exit still", "exit motion", "exit printing"},
+		},
+		{trigger: trigPowerOn, state: printing, config: []*State[int]{cold, still}},
+		{trigger: trigMove, state: printing, config: []*State[int]{cold, moving}, avail: 4},
+		{
+			// Region transition leaving the superstate exits all regions.
+			trigger: trigJam, state: jammed, config: []*State[int]{jammed},
+			log: []string{"exit cold", "exit heater", "exit moving", "exit motion", "exit printing"},
+		},
+	} {
+		log = log[:0]
+		mustNil(sm.FireBg(test.trigger, 1))
+		if sm.State() != test.state {
+			t.Errorf("%s: expected state %s, got %s", test.trigger, test.state.Label(), sm.StateLabel())
+		}
+		if got := sm.Configuration(); fmt.Sprint(got) != fmt.Sprint(test.config) {
+			t.Errorf("%s: expected configuration %v, got %v", test.trigger, test.config, got)
+		}
+		if test.log != nil && fmt.Sprint(log) != fmt.Sprint(test.log) {
+			t.Errorf("%s: expected callbacks %v, got %v", test.trigger, test.log, log)
+		}
+		if avail := sm.TriggersAvailable(); test.avail != 0 && len(avail) != test.avail {
+			t.Errorf("%s: expected %d triggers available, got %v", test.trigger, test.avail, avail)
+		}
+	}
+
+	// Snapshots preserve the active state of each region.
+	mustNil(sm.Restore(Snapshot{State: "printing", Configuration: []string{"heating", "moving"}}))
+	if fmt.Sprint(sm.Configuration()) != fmt.Sprint([]*State[int]{heating, moving}) {
+		t.Errorf("unexpected configuration after restore: %v", sm.Configuration())
+	}
+	if snap := sm.Snapshot(); snap.State != "printing" || len(snap.Configuration) != 2 {
+		t.Errorf("unexpected snapshot: %+v", snap)
+	}
+	for _, config := range [][]string{nil, {"heating"}, {"heating", "hot", "moving"}, {"heating", "heating"}} {
+		if err := sm.Restore(Snapshot{State: "printing", Configuration: config}); err == nil {
+			t.Errorf("expected error restoring configuration %v not covering every region", config)
+		}
+	}
+	if fmt.Sprint(sm.Configuration()) != fmt.Sprint([]*State[int]{heating, moving}) {
+		t.Errorf("failed restore modified configuration: %v", sm.Configuration())
+	}
+
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, sm)
+	mustNil(err)
+	if bytes.Count(buf.Bytes(), []byte("style = dashed;")) != 2 {
+		t.Errorf("expected regions drawn as dashed clusters:\n%s", buf.String())
+	}
+
+	// Guard failures of a region are not reported if another region transitioned.
+	var (
+		par    = NewState("par", 1)
+		ra, rb = NewState("ra", 1), NewState("rb", 1)
+		a1, a2 = NewState("a1", 1), NewState("a2", 1)
+		b1, b2 = NewState("b1", 1), NewState("b2", 1)
+	)
+	mustNil(par.LinkRegions(ra, rb))
+	mustNil(ra.LinkSubstates(a1, a2))
+	mustNil(rb.LinkSubstates(b1, b2))
+	mustNil(ra.SetInitialSubstate(a1))
+	mustNil(rb.SetInitialSubstate(b1))
+	off = NewState("off", 1)
+	off.Permit(trigPowerOn, par)
+	a1.Permit(trigTick, a2, NewGuard("g", func(context.Context, int) error { return errors.New("blocked") }))
+	b1.Permit(trigTick, b2, NewGuard("odd", func(_ context.Context, input int) error {
+		if input%2 == 0 {
+			return errors.New("even")
+		}
+		return nil
+	}))
+	sm = NewStateMachine(off)
+	mustNil(sm.FireBg(trigPowerOn, 1))
+	if err := sm.FireBg(trigTick, 2); err == nil {
+		t.Error("expected guard errors when no region transitioned")
+	}
+	if err := sm.FireBg(trigTick, 1); err != nil || fmt.Sprint(labels(sm.Configuration())) != "[a1 b2]" {
+		t.Errorf("expected region b to transition without error, got %v in %v", err, labels(sm.Configuration()))
+	}
+}
+
+func TestPermitDynamic(t *testing.T) {
+	const trigFail Trigger = "fail"
+	var (
+		sending  = NewState("sending", 1)
+		retrying = NewState("retrying", 1)
+		failed   = NewState("failed", 1)
+		rogue    = NewState("rogue", 1)
+	)
+	const maxRetries = 3
+	selectRetry := NewDestinationSelector("retries left", func(_ context.Context, attempts int) *State[int] {
+		switch {
+		case attempts < 0:
+			return rogue // Not declared as possible destination.
+		case attempts < maxRetries:
+			return retrying
+		}
+		return failed
+	}, retrying, failed)
+	sending.PermitDynamic(trigFail, selectRetry)
+	retrying.Permit(trigFail, sending)
+
+	sm := NewStateMachine(sending)
+	var dsts []string
+	sm.OnTransitioning(NewFringeCallback("log", func(_ context.Context, tr intTransition, _ int) {
+		dsts = append(dsts, tr.Dst.Label())
+	}))
+	var walked int
+	WalkStates(sending, func(s *State[int]) error {
+		walked++
+		return nil
+	})
+	if walked != 3 {
+		t.Errorf("expected all possible destinations walked, got %d states", walked)
+	}
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, edge := range []string{`"sending" -> "retrying"`, `"sending" -> "failed"`, `(retries left)`} {
+		if !bytes.Contains(buf.Bytes(), []byte(edge)) {
+			t.Errorf("expected %s in DOT output:\n%s", edge, buf.String())
+		}
+	}
+
+	err = sm.FireBg(trigFail, -1)
+	if err == nil || sm.State() != sending {
+		t.Errorf("expected error selecting undeclared destination, got %v in state %s", err, sm.StateLabel())
+	}
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if err := sm.FireBg(trigFail, attempt); err != nil {
+			t.Fatal(err)
+		}
+		if sm.State() == retrying {
+			if err := sm.FireBg(trigFail, attempt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if sm.State() != failed {
+		t.Errorf("expected state %s, got %s", failed.Label(), sm.StateLabel())
+	}
+	expect := []string{"retrying", "sending", "retrying", "sending", "retrying", "sending", "failed"}
+	if fmt.Sprint(dsts) != fmt.Sprint(expect) {
+		t.Errorf("expected destinations %v, got %v", expect, dsts)
+	}
+}
+
+func TestMultipleGuardedTransitions(t *testing.T) {
+	const trigSubmit Trigger = "submit"
+	var (
+		draft    = NewState("draft", 0)
+		approved = NewState("approved", 0)
+		review   = NewState("review", 0)
+		rejected = NewState("rejected", 0)
+	)
+	guardSmall := NewGuard("amount < 1000", func(_ context.Context, amount int) error {
+		if amount >= 1000 {
+			return errors.New("amount too large")
+		}
+		return nil
+	})
+	guardLarge := NewGuard("amount >= 1000", func(_ context.Context, amount int) error {
+		if amount < 1000 {
+			return errors.New("amount too small")
+		}
+		return nil
+	})
+	guardPositive := NewGuard("amount > 0", func(_ context.Context, amount int) error {
+		if amount <= 0 {
+			return errors.New("amount not positive")
+		}
+		return nil
+	})
+	draft.Permit(trigSubmit, approved, guardPositive, guardSmall)
+	draft.Permit(trigSubmit, review, guardPositive, guardLarge)
+	for _, s := range []*State[int]{approved, review} {
+		s.Permit("reset", draft)
+	}
+	sm := NewStateMachine(draft)
+	for _, test := range []struct {
+		amount int
+		expect *State[int]
+	}{
+		{amount: 10, expect: approved},
+		{amount: 5000, expect: review},
+	} {
+		if err := sm.FireBg(trigSubmit, test.amount); err != nil {
+			t.Fatal(err)
+		}
+		if sm.State() != test.expect {
+			t.Errorf("amount %d: expected state %s, got %s", test.amount, test.expect.Label(), sm.StateLabel())
+		}
+		sm.FireBg("reset", 0)
+	}
+	err := sm.FireBg(trigSubmit, -5000)
+	var g *GuardClauseError
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !errors.As(err, &g) || !ok || len(joined.Unwrap()) != 2 {
+		t.Errorf("expected guard errors of all transitions, got %v", err)
+	}
+	if sm.State() != draft {
+		t.Errorf("expected state to remain %s, got %s", draft.Label(), sm.StateLabel())
+	}
+	if avail := sm.TriggersAvailable(); len(avail) != 1 {
+		t.Errorf("expected single trigger available, got %v", avail)
+	}
+
+	// Fallback transition without guards registered last.
+	draft.Permit(trigSubmit, rejected)
+	if err := sm.FireBg(trigSubmit, -1); err != nil || sm.State() != rejected {
+		t.Errorf("expected fallback transition, got %v in state %s", err, sm.StateLabel())
+	}
+
+	// Overlapping guards are ambiguous.
+	src := NewState("src", 0)
+	src.Permit(trigSubmit, approved, guardPositive)
+	src.Permit(trigSubmit, review, guardSmall)
+	sm = NewStateMachine(src)
+	sm.RejectAmbiguousTransitions(true)
+	err = sm.FireBg(trigSubmit, 1)
+	var a *AmbiguousTransitionError
+	if !errors.As(err, &a) || !errors.Is(err, ErrAmbiguousTransition) || len(a.Transitions) != 2 {
+		t.Errorf("expected ambiguous transition error, got %v", err)
+	}
+	if err := sm.FireBg(trigSubmit, 5000); err != nil || sm.State() != approved {
+		t.Errorf("expected single permitted transition taken, got %v in state %s", err, sm.StateLabel())
+	}
+
+	// The fallback transition is not ambiguous with a guarded transition.
+	src = NewState("src", 0)
+	src.Permit(trigSubmit, review, guardSmall)
+	src.Permit(trigSubmit, rejected)
+	for _, test := range []struct {
+		amount int
+		expect *State[int]
+	}{
+		{amount: 10, expect: review},
+		{amount: 5000, expect: rejected},
+	} {
+		sm = NewStateMachine(src)
+		sm.RejectAmbiguousTransitions(true)
+		if err := sm.FireBg(trigSubmit, test.amount); err != nil || sm.State() != test.expect {
+			t.Errorf("amount %d: expected state %s, got %v in state %s", test.amount, test.expect.Label(), err, sm.StateLabel())
+		}
+	}
+}
+
+func TestInternalTransition(t *testing.T) {
+	const (
+		trigTick  Trigger = "tick"
+		trigReset Trigger = "reset"
+	)
+	var (
+		super   = NewState("super", 0)
+		running = NewState("running", 0)
+	)
+	super.LinkSubstates(running)
+	var calls []string
+	logger := func(name string) FringeCallback[int] {
+		return NewFringeCallback(name, func(_ context.Context, _ intTransition, _ int) {
+			calls = append(calls, name)
+		})
+	}
+	guardPositive := NewGuard("positive", func(_ context.Context, v int) error {
+		if v <= 0 {
+			return errors.New("not positive")
+		}
+		return nil
+	})
+	for _, s := range []*State[int]{super, running} {
+		s.OnEntry(logger(s.Label() + " entry"))
+		s.OnExit(logger(s.Label() + " exit"))
+		s.OnReentry(logger(s.Label() + " reentry"))
+	}
+	running.InternalTransition(trigTick, logger("count"), guardPositive)
+	super.InternalTransition(trigReset, logger("reset"))
+
+	sm := NewStateMachine(running)
+	var transitioned []string
+	sm.OnTransitioned(NewFringeCallback("log", func(_ context.Context, tr intTransition, _ int) {
+		if !tr.IsInternal() {
+			t.Errorf("expected internal transition, got %s", tr)
+		}
+		transitioned = append(transitioned, tr.Src.Label()+"->"+tr.Dst.Label())
+	}))
+	if err := sm.FireBg(trigTick, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.FireBg(trigReset, 1); err != nil {
+		t.Fatal(err)
+	}
+	var g *GuardClauseError
+	if err := sm.FireBg(trigTick, 0); !errors.As(err, &g) {
+		t.Errorf("expected guard clause error, got %v", err)
+	}
+	if sm.State() != running {
+		t.Errorf("expected state %s, got %s", running.Label(), sm.StateLabel())
+	}
+	expect := []string{"count", "reset"}
+	if fmt.Sprint(calls) != fmt.Sprint(expect) {
+		t.Errorf("expected callbacks %v, got %v", expect, calls)
+	}
+	expect = []string{"running->running", "running->running"}
+	if fmt.Sprint(transitioned) != fmt.Sprint(expect) {
+		t.Errorf("expected transitions %v, got %v", expect, transitioned)
+	}
+	if !sm.StateIsSink() {
+		t.Error("expected state with only internal transitions to be a sink")
+	}
+
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("->")) {
+		t.Errorf("expected no edges for internal transitions:\n%s", buf.String())
+	}
+	for _, label := range []string{`"running" [ label = "running\ntick [positive] / count" ]`, `"super" [ label = "super\nreset / reset" ]`} {
+		if !bytes.Contains(buf.Bytes(), []byte(label)) {
+			t.Errorf("expected %s in DOT output:\n%s", label, buf.String())
+		}
+	}
+}
+
+func TestTransitionEffect(t *testing.T) {
+	const trigGo Trigger = "go"
+	var (
+		super = NewState("super", 0)
+		a     = NewState("a", 0)
+		b     = NewState("b", 0)
+	)
+	super.LinkSubstates(a)
+	var calls []string
+	logger := func(name string) FringeCallback[int] {
+		return NewFringeCallback(name, func(_ context.Context, _ intTransition, _ int) {
+			calls = append(calls, name)
+		})
+	}
+	for _, s := range []*State[int]{super, a, b} {
+		s.OnEntry(logger(s.Label() + " entry"))
+		s.OnExit(logger(s.Label() + " exit"))
+		s.OnReentry(logger(s.Label() + " reentry"))
+	}
+	guardOK := NewGuard("ok", func(_ context.Context, _ int) error { return nil })
+	a.PermitWithEffect(trigGo, b, logger("effect"), guardOK)
+	b.PermitWithEffect(trigGo, b, logger("self effect"))
+
+	sm := NewStateMachine(a)
+	var inspected []string
+	sm.InspectFringes(func(tr intTransition, fcb FringeCallback[int], _ int) {
+		inspected = append(inspected, fcb.String())
+	})
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const edge = `"a" -> "b" [ label = "go\n[ok]\n/ effect", style = "dashed" ]`
+	if !bytes.Contains(buf.Bytes(), []byte(edge)) {
+		t.Errorf("expected %s in DOT output:\n%s", edge, buf.String())
+	}
+	if err := sm.FireBg(trigGo, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.FireBg(trigGo, 0); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"a exit", "super exit", "effect", "b entry", "self effect", "b reentry"}
+	if fmt.Sprint(calls) != fmt.Sprint(expect) {
+		t.Errorf("expected callbacks %v, got %v", expect, calls)
+	}
+	if fmt.Sprint(inspected) != fmt.Sprint(calls) {
+		t.Errorf("expected inspected fringes %v, got %v", calls, inspected)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	const (
+		trigPing  Trigger = "ping"
+		trigPoke  Trigger = "poke"
+		trigLeave Trigger = "leave"
+	)
+	var (
+		super   = NewState("super", 0)
+		a       = NewState("a", 0)
+		b       = NewState("b", 0)
+		outside = NewState("outside", 0)
+	)
+	super.LinkSubstates(a, b)
+	super.Ignore(trigPing)
+	super.Permit(trigPoke, outside)
+	b.Permit(trigPing, a) // Overrides ignore of superstate.
+	a.Ignore(trigPoke)    // Overrides transition of superstate.
+	a.Permit(trigLeave, b)
+
+	sm := NewStateMachine(a)
+	var calls int
+	sm.OnTransitioning(NewFringeCallback("count", func(_ context.Context, _ intTransition, _ int) {
+		calls++
+	}))
+	sm.OnUnhandledTrigger(func(_ *State[int], _ Trigger) error {
+		calls++
+		return nil
+	})
+	for _, trig := range []Trigger{trigPing, trigPoke} {
+		if err := sm.FireBg(trig, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 0 || sm.State() != a {
+		t.Errorf("expected ignored triggers to be no-ops, got %d callbacks in state %s", calls, sm.StateLabel())
+	}
+	if ignored := sm.TriggersIgnored(); fmt.Sprint(ignored) != "[poke ping]" {
+		t.Errorf("expected ignored triggers [poke ping], got %v", ignored)
+	}
+	if avail := sm.TriggersAvailable(); fmt.Sprint(avail) != "[leave]" {
+		t.Errorf("expected available triggers [leave], got %v", avail)
+	}
+
+	sm.FireBg(trigLeave, 0)
+	if ignored := sm.TriggersIgnored(); len(ignored) != 0 {
+		t.Errorf("expected no ignored triggers in %s, got %v", sm.StateLabel(), ignored)
+	}
+	if err := sm.FireBg(trigPing, 0); err != nil || sm.State() != a {
+		t.Errorf("expected substate transition to override ignore, got %v in state %s", err, sm.StateLabel())
+	}
+}
+
+func TestDefer(t *testing.T) {
+	const (
+		trigSend      Trigger = "send"
+		trigConnect   Trigger = "connect"
+		trigConnected Trigger = "connected"
+		trigDrop      Trigger = "drop"
+	)
+	var (
+		offline    = NewState("offline", 0)
+		connecting = NewState("connecting", 0)
+		connected  = NewState("connected", 0)
+		notReady   = NewState("not ready", 0)
+	)
+	notReady.LinkSubstates(offline, connecting)
+	notReady.Defer(trigSend)
+	offline.Permit(trigConnect, connecting)
+	connecting.Permit(trigConnected, connected)
+	connected.Permit(trigDrop, offline)
+	var sent []int
+	connected.InternalTransition(trigSend, NewFringeCallback("send", func(_ context.Context, _ intTransition, n int) {
+		sent = append(sent, n)
+	}))
+
+	sm := NewStateMachine(offline)
+	for _, trig := range []Trigger{trigSend, trigConnect, trigSend} {
+		if err := sm.FireBg(trig, len(sm.Deferred())+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deferred := sm.Deferred(); fmt.Sprint(deferred) != "[send send]" {
+		t.Errorf("expected deferred triggers [send send], got %v", deferred)
+	}
+	if len(sent) != 0 {
+		t.Errorf("expected no triggers sent before connecting, got %v", sent)
+	}
+	if err := sm.FireBg(trigConnected, 0); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[1 2]" || len(sm.Deferred()) != 0 {
+		t.Errorf("expected deferred triggers replayed in order, sent %v with %v deferred", sent, sm.Deferred())
+	}
+
+	sm.FireBg(trigDrop, 0)
+	sm.FireBg(trigSend, 3)
+	if n := sm.PurgeDeferred(); n != 1 {
+		t.Errorf("expected 1 deferred trigger purged, got %d", n)
+	}
+	sm.FireBg(trigConnect, 0)
+	sm.FireBg(trigConnected, 0)
+	if fmt.Sprint(sent) != "[1 2]" {
+		t.Errorf("expected purged trigger not sent, sent %v", sent)
+	}
+}
+
+func TestPermitAutomatic(t *testing.T) {
+	const (
+		trigSubmit Trigger = "submit"
+		trigRetry  Trigger = "retry"
+	)
+	var (
+		editing    = NewState("editing", 0)
+		validating = NewState("validating", 0)
+		valid      = NewState("valid", 0)
+		invalid    = NewState("invalid", 0)
+		archived   = NewState("archived", 0)
+	)
+	guardValid := NewGuard("valid", func(_ context.Context, v int) error {
+		if v < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	})
+	editing.Permit(trigSubmit, validating)
+	validating.PermitAutomatic(valid, guardValid)
+	validating.PermitAutomatic(invalid)
+	valid.PermitAutomatic(archived)
+	invalid.Permit(trigRetry, editing)
+
+	sm := NewStateMachine(editing)
+	var dsts []string
+	sm.OnTransitioned(NewFringeCallback("log", func(_ context.Context, tr intTransition, _ int) {
+		dsts = append(dsts, tr.Trigger.String()+":"+tr.Dst.Label())
+	}))
+	if err := sm.FireBg(trigSubmit, -1); err != nil {
+		t.Fatal(err)
+	}
+	if sm.State() != invalid {
+		t.Errorf("expected state %s, got %s", invalid.Label(), sm.StateLabel())
+	}
+	sm.FireBg(trigRetry, 0)
+	if err := sm.FireBg(trigSubmit, 1); err != nil {
+		t.Fatal(err)
+	}
+	if sm.State() != archived {
+		t.Errorf("expected state %s, got %s", archived.Label(), sm.StateLabel())
+	}
+	expect := []string{"submit:validating", "(automatic):invalid", "retry:editing", "submit:validating", "(automatic):valid", "(automatic):archived"}
+	if fmt.Sprint(dsts) != fmt.Sprint(expect) {
+		t.Errorf("expected transitions %v, got %v", expect, dsts)
+	}
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, NewStateMachine(editing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const edge = `"validating" -> "valid" [ label = "(automatic)\n[valid]", style = "dashed", penwidth = 2 ]`
+	if !bytes.Contains(buf.Bytes(), []byte(edge)) {
+		t.Errorf("expected %s in DOT output:\n%s", edge, buf.String())
+	}
+
+	// Automatic transitions of superstates are evaluated after those of their substates.
+	idle, work, busy, spare, done := NewState("idle", 0), NewState("work", 0), NewState("busy", 0), NewState("spare", 0), NewState("done", 0)
+	work.LinkSubstates(busy, spare)
+	work.SetInitialSubstate(busy)
+	idle.Permit(trigSubmit, work)
+	work.PermitAutomatic(done, guardValid)
+	busy.PermitAutomatic(spare, NewGuard("two", func(_ context.Context, v int) error {
+		if v != 2 {
+			return errors.New("not two")
+		}
+		return nil
+	}))
+	for _, test := range []struct {
+		input  int
+		expect []string
+	}{
+		{input: -1, expect: []string{"submit:work"}},
+		{input: 1, expect: []string{"submit:work", "(automatic):done"}},
+		{input: 2, expect: []string{"submit:work", "(automatic):spare", "(automatic):done"}},
+	} {
+		sm = NewStateMachine(idle)
+		dsts = dsts[:0]
+		sm.OnTransitioned(NewFringeCallback("log", func(_ context.Context, tr intTransition, _ int) {
+			dsts = append(dsts, tr.Trigger.String()+":"+tr.Dst.Label())
+		}))
+		if err := sm.FireBg(trigSubmit, test.input); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(dsts) != fmt.Sprint(test.expect) {
+			t.Errorf("input %d: expected transitions %v, got %v", test.input, test.expect, dsts)
+		}
+	}
+
+	// Automatic cycle is detected before re-entering a state.
+	a := NewState("a", 0)
+	b := NewState("b", 0)
+	c := NewState("c", 0)
+	a.Permit(trigSubmit, b)
+	b.PermitAutomatic(c)
+	c.PermitAutomatic(b)
+	sm = NewStateMachine(a)
+	err = sm.FireBg(trigSubmit, 0)
+	var loop *AutomaticLoopError
+	if !errors.As(err, &loop) || !errors.Is(err, ErrAutomaticLoop) || fmt.Sprint(loop.Path) != "[b c b]" {
+		t.Errorf("expected automatic loop error, got %v", err)
+	}
+	if sm.State() != c {
+		t.Errorf("expected state %s, got %s", c.Label(), sm.StateLabel())
+	}
+
+	// Entering a superstate rested in through a substate not rested in is no cycle.
+	p, x, y, q := NewState("p", 0), NewState("x", 0), NewState("y", 0), NewState("q", 0)
+	p.LinkSubstates(x, y)
+	p.SetInitialSubstate(x)
+	a = NewState("a", 0)
+	a.Permit(trigSubmit, y)
+	y.PermitAutomatic(q)
+	q.PermitAutomatic(p)
+	sm = NewStateMachine(a)
+	if err := sm.FireBg(trigSubmit, 0); err != nil || sm.State() != x {
+		t.Errorf("expected to settle in %s, got %s: %v", x.Label(), sm.StateLabel(), err)
+	}
+
+	// Choices are resolved before checking for cycles.
+	a, b, c = NewState("a", 0), NewState("b", 0), NewState("c", 0)
+	choice := NewChoice("choice", 0)
+	a.Permit(trigSubmit, b)
+	b.PermitAutomatic(choice)
+	choice.Branch(b)
+	sm = NewStateMachine(a)
+	if err := sm.FireBg(trigSubmit, 0); !errors.As(err, &loop) || fmt.Sprint(loop.Path) != "[b b]" {
+		t.Errorf("expected automatic loop through choice, got %v", err)
+	}
+	a, b, c, choice = NewState("a", 0), NewState("b", 0), NewState("c", 0), NewChoice("choice", 0)
+	choice2 := NewChoice("choice2", 0)
+	a.Permit(trigSubmit, b)
+	b.PermitAutomatic(choice)
+	choice.Branch(c)
+	c.PermitAutomatic(choice2)
+	choice2.Branch(b)
+	sm = NewStateMachine(a)
+	if err := sm.FireBg(trigSubmit, 0); !errors.As(err, &loop) || fmt.Sprint(loop.Path) != "[b c b]" {
+		t.Errorf("expected automatic loop through choices, got %v", err)
+	}
+}
+
+func TestChoice(t *testing.T) {
+	const (
+		trigGrade Trigger = "grade"
+		trigReset Trigger = "reset"
+	)
+	var (
+		pending = NewState("pending", 0)
+		grade   = NewChoice("grade?", 0)
+		pass    = NewState("pass", 0)
+		honors  = NewState("honors", 0)
+		fail    = NewState("fail", 0)
+	)
+	atLeast := func(min int) GuardClause[int] {
+		return NewGuard(fmt.Sprintf(">= %d", min), func(_ context.Context, score int) error {
+			if score < min {
+				return errors.New("score too low")
+			}
+			return nil
+		})
+	}
+	pending.Permit(trigGrade, grade)
+	grade.Branch(honors, atLeast(90))
+	grade.Branch(pass, atLeast(60))
+	for _, s := range []*State[int]{pass, honors, fail} {
+		s.Permit(trigReset, pending)
+	}
+	grade.OnEntry(NewFringeCallback("never", func(_ context.Context, _ intTransition, _ int) {
+		t.Error("choice entry callback called")
+	}))
+
+	sm := NewStateMachine(pending)
+	if err := sm.Validate(); err == nil {
+		t.Error("expected choice without else branch to be rejected")
+	}
+	err := sm.FireBg(trigGrade, 10)
+	var g *GuardClauseError
+	if !errors.As(err, &g) || sm.State() != pending {
+		t.Errorf("expected guard clause error, got %v in state %s", err, sm.StateLabel())
+	}
+	grade.Branch(fail)
+	if err := sm.Validate(); err != nil {
+		t.Error(err)
+	}
+	var transitioned []string
+	sm.OnTransitioned(NewFringeCallback("log", func(_ context.Context, tr intTransition, _ int) {
+		transitioned = append(transitioned, tr.Dst.Label())
+	}))
+	for _, test := range []struct {
+		score  int
+		expect *State[int]
+	}{
+		{score: 95, expect: honors},
+		{score: 70, expect: pass},
+		{score: 10, expect: fail},
+	} {
+		if err := sm.FireBg(trigGrade, test.score); err != nil {
+			t.Fatal(err)
+		}
+		if sm.State() != test.expect {
+			t.Errorf("score %d: expected state %s, got %s", test.score, test.expect.Label(), sm.StateLabel())
+		}
+		sm.FireBg(trigReset, 0)
+	}
+	expect := []string{"honors", "pending", "pass", "pending", "fail", "pending"}
+	if fmt.Sprint(transitioned) != fmt.Sprint(expect) {
+		t.Errorf("expected transitions %v, got %v", expect, transitioned)
+	}
+	var buf bytes.Buffer
+	_, err = WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`"grade?" [ shape = diamond ]`, `"grade?" -> "fail" [ label = "[else]", style = "dashed" ]`} {
+		if !bytes.Contains(buf.Bytes(), []byte(line)) {
+			t.Errorf("expected %s in DOT output:\n%s", line, buf.String())
+		}
+	}
+
+	// Choices branching to each other are rejected instead of spinning.
+	start, ping, pong := NewState("start", 0), NewChoice("ping", 0), NewChoice("pong", 0)
+	start.Permit(trigGrade, ping)
+	ping.Branch(pong)
+	pong.Branch(ping)
+	sm = NewStateMachine(start)
+	if err := sm.Validate(); err == nil || !strings.Contains(err.Error(), "branch back") {
+		t.Errorf("expected choice cycle to be rejected, got %v", err)
+	}
+	if err := sm.FireBg(trigGrade, 0); err == nil || sm.State() != start {
+		t.Errorf("expected error firing into choice cycle, got %v in state %s", err, sm.StateLabel())
+	}
+
+	// Branches are evaluated after the guard clauses of the transition.
+	var order []string
+	probe := func(name string) GuardClause[int] {
+		return NewGuard(name, func(_ context.Context, input int) error {
+			order = append(order, name)
+			if input < 0 {
+				return errors.New("negative")
+			}
+			return nil
+		})
+	}
+	start, grade = NewState("start", 0), NewChoice("grade", 0)
+	start.Permit(trigGrade, grade, probe("trguard"))
+	grade.Branch(pass, probe("branch"))
+	grade.Branch(fail)
+	sm = NewStateMachine(start)
+	sm.OnTransitioning(NewFringeCallback("transitioning", func(context.Context, intTransition, int) {
+		order = append(order, "transitioning")
+	}))
+	if err := sm.FireBg(trigGrade, -1); err == nil || fmt.Sprint(order) != "[trguard]" {
+		t.Errorf("expected only transition guard evaluated, got %v: %v", order, err)
+	}
+	order = nil
+	if err := sm.FireBg(trigGrade, 1); err != nil || fmt.Sprint(order) != "[trguard branch transitioning]" {
+		t.Errorf("unexpected evaluation order %v: %v", order, err)
+	}
+}
+
+func TestFinalState(t *testing.T) {
+	const (
+		trigStart Trigger = "start"
+		trigStep  Trigger = "step"
+	)
+	var (
+		idle     = NewState("idle", 0)
+		job      = NewState("job", 0)
+		download = NewState("download", 0)
+		fetching = NewState("fetching", 0)
+		fetched  = NewState("fetched", 0)
+		unpack   = NewState("unpack", 0)
+		working  = NewState("working", 0)
+		unpacked = NewState("unpacked", 0)
+		finished = NewState("finished", 0)
+	)
+	job.LinkRegions(download, unpack)
+	download.LinkSubstates(fetching, fetched)
+	download.SetInitialSubstate(fetching)
+	unpack.LinkSubstates(working, unpacked)
+	unpack.SetInitialSubstate(working)
+	fetched.SetFinal()
+	unpacked.SetFinal()
+	finished.SetFinal()
+	idle.Permit(trigStart, job)
+	fetching.Permit(trigStep, fetched)
+	working.Permit(trigStep, unpacked, NewGuard("unpack ready", func(_ context.Context, v int) error {
+		if v == 0 {
+			return errors.New("not ready")
+		}
+		return nil
+	}))
+	job.Permit(TriggerDone, finished)
+
+	sm := NewStateMachine(idle)
+	var done []string
+	sm.OnDone(NewFringeCallback("done", func(_ context.Context, tr intTransition, _ int) {
+		done = append(done, tr.Trigger.String()+":"+tr.Src.Label())
+	}))
+	sm.FireBg(trigStart, 0)
+	if avail := sm.TriggersAvailable(); fmt.Sprint(avail) != "[step]" {
+		t.Errorf("expected completion transition not to be available, got %v", avail)
+	}
+	sm.FireBg(trigStep, 0) // Only download region completes.
+	if sm.Done() || len(done) != 0 {
+		t.Fatalf("expected state machine not done in %v", sm.Configuration())
+	}
+	sm.FireBg(trigStep, 1)
+	if !sm.Done() || sm.State() != finished {
+		t.Errorf("expected state machine done in %s, got %s", finished.Label(), sm.StateLabel())
+	}
+	if fmt.Sprint(done) != "[(done):fetched]" {
+		t.Errorf("expected done callback called once on completion, got %v", done)
+	}
+	if !sm.StateIsSink() {
+		t.Error("expected final state to be a sink")
+	}
+}
+
+func TestStateContext(t *testing.T) {
+	const (
+		trigStart Trigger = "start"
+		trigNext  Trigger = "next"
+		trigStop  Trigger = "stop"
+	)
+	var (
+		idle    = NewState("idle", 0)
+		running = NewState("running", 0)
+		first   = NewState("first", 0)
+		second  = NewState("second", 0)
+	)
+	running.LinkSubstates(first, second)
+	running.SetInitialSubstate(first)
+	idle.Permit(trigStart, running)
+	first.Permit(trigNext, second)
+	running.Permit(trigStop, idle)
+
+	sm := NewStateMachine(idle)
+	root, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+	sm.SetRootContext(root)
+	var runningCtx, firstCtx context.Context
+	running.OnEntry(NewFringeCallback("worker", func(_ context.Context, _ intTransition, _ int) {
+		runningCtx = sm.StateContext(running)
+	}))
+	first.OnEntry(NewFringeCallback("worker", func(_ context.Context, _ intTransition, _ int) {
+		firstCtx = sm.StateContext(first)
+	}))
+	if err := sm.StateContext(running).Err(); err == nil {
+		t.Error("expected context of inactive state to be cancelled")
+	}
+	sm.FireBg(trigStart, 0)
+	if runningCtx.Err() != nil || firstCtx.Err() != nil {
+		t.Fatal("expected contexts of entered states to be active")
+	}
+	if sm.StateContext(running) != runningCtx {
+		t.Error("expected same context for state while active")
+	}
+	sm.FireBg(trigNext, 0)
+	if firstCtx.Err() == nil || runningCtx.Err() != nil {
+		t.Errorf("expected only context of exited state cancelled, got %v and %v", firstCtx.Err(), runningCtx.Err())
+	}
+	secondCtx := sm.StateContext(second)
+	sm.FireBg(trigStop, 0)
+	if runningCtx.Err() == nil || secondCtx.Err() == nil {
+		t.Error("expected contexts of exited superstate and substate cancelled")
+	}
+	sm.FireBg(trigStart, 0)
+	cancelRoot()
+	if runningCtx = sm.StateContext(running); runningCtx.Err() == nil {
+		t.Error("expected state context cancelled along with root")
+	}
+}
+
+func TestDo(t *testing.T) {
+	const (
+		trigStart Trigger = "start"
+		trigStop  Trigger = "stop"
+		trigFault Trigger = "fault"
+	)
+	var (
+		idle    = NewState("idle", 0)
+		running = NewState("running", 0)
+		faulted = NewState("faulted", 0)
+	)
+	idle.Permit(trigStart, running)
+	running.Permit(trigStop, idle)
+	running.Permit(trigFault, faulted)
+	faulted.Permit(trigStart, running)
+
+	started := make(chan struct{})
+	var (
+		stopped bool
+		ssm     *SyncStateMachine[int]
+	)
+	running.Do(NewActivity("work", func(ctx context.Context, fail int) error {
+		started <- struct{}{}
+		if fail != 0 {
+			return errors.New("device fault")
+		}
+		<-ctx.Done()
+		if ssm != nil && ssm.StateLabel() == "" { // Must not deadlock.
+			t.Error("unexpected empty state label")
+		}
+		stopped = true
+		return ctx.Err()
+	}), trigFault)
+	running.OnExit(NewFringeCallback("check", func(_ context.Context, tr intTransition, _ int) {
+		if ssm == nil && tr.Trigger == trigStop && !stopped {
+			t.Error("expected activity to return before exit callbacks")
+		}
+	}))
+
+	sm := NewStateMachine(idle)
+	sm.FireBg(trigStart, 0)
+	<-started
+	if err := sm.FireBg(trigStop, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Activities of a SyncStateMachine may call its methods once cancelled and
+	// are waited for after the lock is released.
+	stopped = false
+	ssm = NewSyncStateMachine(NewStateMachine(idle))
+	ssm.FireBg(trigStart, 0)
+	<-started
+	if err := ssm.FireBg(trigStop, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !stopped || ssm.State() != idle {
+		t.Errorf("expected activity stopped on exit, got state %s", ssm.StateLabel())
+	}
+
+	ssm.FireBg(trigStart, 1)
+	<-started
+	deadline := time.Now().Add(time.Second)
+	for ssm.State() != faulted && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if ssm.State() != faulted {
+		t.Errorf("expected activity error to fire %s, got state %s", trigFault, ssm.StateLabel())
+	}
+
+	// An activity may fire the trigger exiting its own state with its context.
+	const trigFinished Trigger = "finished"
+	working := NewState("working", 0)
+	idle.Permit(trigFinished, working)
+	working.Permit(trigFinished, idle)
+	fired := make(chan error)
+	working.Do(NewActivity("job", func(ctx context.Context, input int) error {
+		fired <- ssm.Fire(ctx, trigFinished, input)
+		return nil
+	}), "")
+	ssm = NewSyncStateMachine(NewStateMachine(idle))
+	ssm.FireBg(trigFinished, 0)
+	select {
+	case err := <-fired:
+		if err != nil || ssm.State() != idle {
+			t.Errorf("expected activity to exit its state, got state %s and error %v", ssm.StateLabel(), err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("activity exiting its own state deadlocked")
+	}
+}
+
+func TestFallibleCallbackRollback(t *testing.T) {
+	const trigGo Trigger = "go"
+	var (
+		super = NewState("super", 0)
+		a     = NewState("a", 0)
+		b     = NewState("b", 0)
+		c     = NewState("c", 0)
+	)
+	super.LinkSubstates(a)
+	super.SetHistory(HistoryDeep)
+	var calls []string
+	logger := func(name string) FringeCallback[int] {
+		return NewFringeCallback(name, func(_ context.Context, _ intTransition, _ int) {
+			calls = append(calls, name)
+		})
+	}
+	errFault := errors.New("fault")
+	// fallible returns a callback which fails when the input is failOn.
+	fallible := func(name string, failOn int) FringeCallback[int] {
+		return NewFallibleCallback(name, func(_ context.Context, _ intTransition, input int) error {
+			calls = append(calls, name)
+			if input == failOn {
+				return errFault
+			}
+			return nil
+		}).WithCompensation(logger("undo " + name))
+	}
+	a.OnExit(fallible("a exit", 1))
+	super.OnExit(logger("super exit"))
+	a.PermitWithEffect(trigGo, b, fallible("effect", 2))
+	b.OnEntry(fallible("b entry", 3))
+	b.Permit(trigGo, c)
+	c.OnEntry(fallible("c entry", 4))
+
+	sm := NewStateMachine(a)
+	err := sm.FireBg(trigGo, 1)
+	var cbErr *CallbackError
+	if !errors.As(err, &cbErr) || !errors.Is(err, errFault) {
+		t.Fatalf("expected CallbackError wrapping fault, got %v", err)
+	}
+	if cbErr.Label != "a exit" || cbErr.Phase != PhaseExit || cbErr.State != "a" || cbErr.Trigger != trigGo {
+		t.Errorf("expected exit callback of a to fail, got %+v", cbErr)
+	}
+	if sm.State() != a || len(calls) != 1 {
+		t.Errorf("expected no compensation and state a, got %v in state %s", calls, sm.StateLabel())
+	}
+
+	for _, test := range []struct {
+		input  int
+		phase  Phase
+		expect []string
+	}{
+		{input: 2, phase: PhaseEffect, expect: []string{"a exit", "super exit", "effect", "undo a exit"}},
+		{input: 3, phase: PhaseEntry, expect: []string{"a exit", "super exit", "effect", "b entry", "undo effect", "undo a exit"}},
+	} {
+		calls = nil
+		err := sm.FireBg(trigGo, test.input)
+		if !errors.As(err, &cbErr) || cbErr.Phase != test.phase {
+			t.Fatalf("expected %s callback to fail, got %v", test.phase, err)
+		}
+		if fmt.Sprint(calls) != fmt.Sprint(test.expect) {
+			t.Errorf("expected callbacks %v, got %v", test.expect, calls)
+		}
+		if sm.State() != a || sm.History(super) != nil {
+			t.Errorf("expected rollback to state a with no history, got %s and %v", sm.StateLabel(), sm.History(super))
+		}
+	}
+	if err := sm.FireBg(trigGo, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sm.State() != b || sm.History(super) != a {
+		t.Errorf("expected state b with history a, got %s", sm.StateLabel())
+	}
+}
+
+func TestRollbackRestoresSource(t *testing.T) {
+	const (
+		trigStart   Trigger = "start"
+		trigGo      Trigger = "go"
+		trigTimeout Trigger = "timeout"
+	)
+	var (
+		idle = NewState("idle", 0)
+		a    = NewState("a", 0)
+		b    = NewState("b", 0)
+		sm   *StateMachine[int]
+		aCtx context.Context
+	)
+	idle.Permit(trigStart, a)
+	a.Permit(trigGo, b)
+	a.Permit(trigTimeout, idle)
+	a.After(10*time.Second, trigTimeout)
+	a.OnEntry(NewFringeCallback("watch", func(context.Context, intTransition, int) {
+		aCtx = sm.StateContext(a)
+	}))
+	inputs := make(chan int)
+	a.Do(NewActivity("work", func(ctx context.Context, input int) error {
+		inputs <- input
+		<-ctx.Done()
+		return nil
+	}), "")
+	b.OnEntry(NewFallibleCallback("b entry", func(context.Context, intTransition, int) error {
+		return errors.New("fail")
+	}))
+	clock := &fakeClock{}
+	sm = NewStateMachine(idle)
+	sm.SetClock(clock)
+	sm.FireBg(trigStart, 7)
+	<-inputs
+	clock.Advance(6 * time.Second)
+	if err := sm.FireBg(trigGo, 1); err == nil {
+		t.Fatal("expected entry callback to fail")
+	}
+	if sm.State() != a || aCtx.Err() != nil {
+		t.Errorf("expected state a with its context restored, got %s and %v", sm.StateLabel(), aCtx.Err())
+	}
+	if input := <-inputs; input != 7 {
+		t.Errorf("expected activity relaunched with entry input 7, got %d", input)
+	}
+	clock.Advance(4 * time.Second) // Timer keeps its original deadline.
+	if sm.State() != idle || aCtx.Err() == nil {
+		t.Errorf("expected timeout to idle cancelling context of a, got %s", sm.StateLabel())
+	}
+}
+
+func TestPanicPolicy(t *testing.T) {
+	const (
+		trigGo   Trigger = "go"
+		trigBack Trigger = "back"
+	)
+	var (
+		a     = NewState("a", 0)
+		b     = NewState("b", 0)
+		fault = NewState("fault", 0)
+	)
+	a.Permit(trigGo, b, NewGuard("guard", func(_ context.Context, input int) error {
+		if input == 1 {
+			panic("guard panic")
+		}
+		return nil
+	}))
+	b.Permit(trigBack, a)
+	var undone bool
+	a.OnExit(NewFringeCallback("a exit", func(context.Context, intTransition, int) {}).
+		WithCompensation(NewFringeCallback("undo a exit", func(context.Context, intTransition, int) { undone = true })))
+	b.OnEntry(NewFringeCallback("b entry", func(_ context.Context, _ intTransition, input int) {
+		if input == 2 {
+			var m map[int]int
+			m[0] = 1 // Runtime error.
+		}
+	}))
+	var faultTrigger Trigger
+	fault.OnEntry(NewFringeCallback("fault entry", func(_ context.Context, tr intTransition, _ int) {
+		faultTrigger = tr.Trigger
+	}))
+
+	sm := NewStateMachine(a)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic to propagate by default")
+			}
+		}()
+		sm.FireBg(trigGo, 1)
+	}()
+
+	// State machine remains usable after a propagated panic is recovered.
+	func() {
+		defer func() { recover() }()
+		sm.FireBg(trigGo, 2)
+	}()
+	if sm.State() != a || sm.StateIsSink() || len(sm.TriggersAvailable()) != 1 || undone {
+		t.Errorf("expected state a restored after propagated panic, got state %s", sm.StateLabel())
+	}
+	result, err := sm.FireWithResult(context.Background(), trigGo, 0)
+	if err != nil || undone || fmt.Sprint(labels(result.Exited)) != "[a]" || fmt.Sprint(labels(result.Entered)) != "[b]" {
+		t.Errorf("unexpected transition after propagated panic: %v exited %v entered %v", err, labels(result.Exited), labels(result.Entered))
+	}
+
+	sm = NewStateMachine(a)
+	sm.SetPanicPolicy(PanicRollback, nil)
+	err = sm.FireBg(trigGo, 1)
+	var p *PanicError
+	if !errors.As(err, &p) || p.Phase != PhaseGuard || p.Label != "guard" || p.Value != "guard panic" || len(p.Stack) == 0 {
+		t.Fatalf("expected PanicError from guard, got %v", err)
+	}
+	err = sm.FireBg(trigGo, 2)
+	var runtimeErr runtime.Error
+	if !errors.As(err, &p) || p.Phase != PhaseEntry || p.Label != "b entry" || !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected PanicError wrapping runtime error from entry callback, got %v", err)
+	}
+	if sm.State() != a || !undone {
+		t.Errorf("expected rollback to state a with compensation run, got state %s", sm.StateLabel())
+	}
+
+	sm.SetPanicPolicy(PanicFault, fault)
+	err = sm.FireBg(trigGo, 2)
+	if !errors.As(err, &p) || sm.State() != fault || faultTrigger != TriggerFault {
+		t.Errorf("expected fault state entered through %s, got state %s and error %v", TriggerFault, sm.StateLabel(), err)
+	}
+
+	// State machine remains usable after the transition into fault panics.
+	brokenFault := NewState("broken fault", 0)
+	brokenFault.OnEntry(NewFringeCallback("fault entry", func(context.Context, intTransition, int) {
+		panic("fault entry panic")
+	}))
+	sm = NewStateMachine(a)
+	sm.SetPanicPolicy(PanicFault, brokenFault)
+	undone = false
+	func() {
+		defer func() {
+			if v := recover(); v != "fault entry panic" {
+				t.Errorf("expected fault entry panic to propagate, got %v", v)
+			}
+		}()
+		sm.FireBg(trigGo, 2)
+	}()
+	if sm.State() != a || !undone {
+		t.Errorf("expected state a restored after fault transition panic, got state %s", sm.StateLabel())
+	}
+	result, err = sm.FireWithResult(context.Background(), trigGo, 0)
+	if err != nil || fmt.Sprint(labels(result.Exited)) != "[a]" || fmt.Sprint(labels(result.Entered)) != "[b]" {
+		t.Errorf("unexpected transition after fault transition panic: %v exited %v entered %v", err, labels(result.Exited), labels(result.Entered))
+	}
+}
+
+func TestFireWithResult(t *testing.T) {
+	const (
+		trigGo   Trigger = "go"
+		trigStay Trigger = "stay"
+	)
+	var (
+		super = NewState("super", 0)
+		a     = NewState("a", 0)
+		b     = NewState("b", 0)
+		c     = NewState("c", 0)
+	)
+	super.LinkSubstates(a)
+	noop := func(label string) FringeCallback[int] {
+		return NewFringeCallback(label, func(context.Context, intTransition, int) {})
+	}
+	a.OnExit(noop("a exit"))
+	super.OnExit(noop("super exit"))
+	a.PermitWithEffect(trigGo, b, noop("effect"))
+	b.OnEntry(noop("b entry"))
+	b.PermitAutomatic(c)
+	c.Permit(trigStay, c)
+	c.OnReentry(noop("c reentry"))
+
+	sm := NewStateMachine(a)
+	sm.OnTransitioned(noop("transitioned"))
+	result, err := sm.FireWithResult(context.Background(), trigGo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Transitions) != 2 || result.Transitions[0].Dst != b || result.Transitions[1].Trigger != TriggerAutomatic || result.Reentry() {
+		t.Errorf("expected transition to b followed by automatic transition, got %v", result.Transitions)
+	}
+	const expectStates = "[a super b] [b c]"
+	if got := fmt.Sprint(labels(result.Exited), " ", labels(result.Entered)); got != expectStates {
+		t.Errorf("expected exited and entered states %s, got %s", expectStates, got)
+	}
+	var callbacks []string
+	for _, run := range result.Callbacks {
+		callbacks = append(callbacks, run.Phase.String()+":"+run.Label)
+	}
+	expect := []string{"exit:a exit", "exit:super exit", "effect:effect", "entry:b entry", "transitioned:transitioned", "transitioned:transitioned"}
+	if fmt.Sprint(callbacks) != fmt.Sprint(expect) {
+		t.Errorf("expected callbacks %v, got %v", expect, callbacks)
+	}
+
+	result, err = sm.FireWithResult(context.Background(), trigStay, 0)
+	if err != nil || !result.Reentry() || len(result.Exited)+len(result.Entered) != 0 {
+		t.Errorf("expected reentry with no states exited or entered, got %+v, %v", result, err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	const (
+		trigGo     Trigger = "go"
+		trigStay   Trigger = "stay"
+		trigIgnore Trigger = "ignore"
+	)
+	var (
+		super = NewState("super", 0)
+		a     = NewState("a", 0)
+		b     = NewState("b", 0)
+		c     = NewState("c", 0)
+	)
+	super.LinkSubstates(a)
+	super.SetHistory(HistoryShallow)
+	var calls []string
+	logger := func(name string) FringeCallback[int] {
+		return NewFringeCallback(name, func(_ context.Context, _ intTransition, _ int) {
+			calls = append(calls, name)
+		})
+	}
+	a.OnExit(logger("a exit"))
+	super.OnExit(logger("super exit"))
+	a.PermitWithEffect(trigGo, b, logger("effect"), NewGuard("positive", func(_ context.Context, input int) error {
+		if input <= 0 {
+			return errors.New("not positive")
+		}
+		return nil
+	}))
+	a.Permit(trigStay, a)
+	a.OnReentry(logger("a reentry"))
+	a.Ignore(trigIgnore)
+	b.OnEntry(logger("b entry"))
+	b.PermitAutomatic(c)
+
+	sm := NewStateMachine(a)
+	sm.OnTransitioning(logger("transitioning"))
+	plan, err := sm.Plan(context.Background(), trigGo, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 || sm.State() != a || sm.History(super) != nil {
+		t.Fatalf("expected no side effects, got callbacks %v in state %s", calls, sm.StateLabel())
+	}
+	if len(plan.Transitions) != 1 || plan.Transitions[0].Dst != b {
+		t.Errorf("expected transition to b, got %v", plan.Transitions)
+	}
+	if got := fmt.Sprint(labels(plan.Exited), labels(plan.Entered)); got != "[a super] [b]" {
+		t.Errorf("expected a and super exited and b entered, got %s", got)
+	}
+	var planned []string
+	for _, run := range plan.Callbacks {
+		planned = append(planned, run.Label)
+	}
+	sm.FireBg(trigGo, 1)
+	// The automatic transition to c is not planned.
+	if fmt.Sprint(planned) != fmt.Sprint(calls[:len(calls)-1]) {
+		t.Errorf("expected planned callbacks %v to match callbacks run %v", planned, calls)
+	}
+
+	sm = NewStateMachine(a)
+	if _, err := sm.Plan(context.Background(), trigGo, 0); err == nil {
+		t.Error("expected guard clause error")
+	}
+	plan, err = sm.Plan(context.Background(), trigStay, 0)
+	if err != nil || !plan.Reentry() || len(plan.Callbacks) != 1 {
+		t.Errorf("expected reentry plan, got %+v, %v", plan, err)
+	}
+	plan, err = sm.Plan(context.Background(), trigIgnore, 0)
+	if err != nil || len(plan.Transitions) != 0 {
+		t.Errorf("expected empty plan for ignored trigger, got %+v, %v", plan, err)
+	}
+	if _, err := sm.Plan(context.Background(), "unknown", 0); !errors.Is(err, ErrUnhandledTrigger) {
+		t.Errorf("expected unhandled trigger error, got %v", err)
+	}
+}
+
+func TestExplainTriggers(t *testing.T) {
+	const (
+		trigExecute Trigger = "execute"
+		trigCancel  Trigger = "cancel"
+		trigQuote   Trigger = "quote"
+	)
+	var (
+		super   = NewState("super", 0)
+		idle    = NewState("idle", 0)
+		trading = NewState("trading", 0)
+	)
+	super.LinkSubstates(idle)
+	fail := func(label string) GuardClause[int] {
+		return NewGuard(label, func(context.Context, int) error { return errors.New(label + " exceeded") })
+	}
+	pass := NewGuard("ok", func(context.Context, int) error { return nil })
+	idle.Permit(trigExecute, trading, fail("quote staleness"), fail("risk limit"))
+	idle.Permit(trigExecute, idle, fail("manual override"), pass)
+	idle.Permit(trigQuote, idle, pass)
+	super.Permit(trigCancel, trading)
+
+	sm := NewStateMachine(idle)
+	explained := sm.ExplainTriggers(context.Background(), 0)
+	if len(explained) != 3 {
+		t.Fatalf("expected 3 triggers explained, got %v", explained)
+	}
+	for _, permitted := range []Trigger{trigQuote, trigCancel} {
+		if err, ok := explained[permitted]; !ok || err != nil {
+			t.Errorf("expected %s permitted, got %v", permitted, err)
+		}
+	}
+	err := explained[trigExecute]
+	var guardErr *GuardClauseError
+	if !errors.As(err, &guardErr) || guardErr.Label != "quote staleness" {
+		t.Fatalf("expected first guard clause error to be quote staleness, got %v", err)
+	}
+	const expect = "guard clause \"quote staleness\" failed: quote staleness exceeded\n" +
+		"guard clause \"risk limit\" failed: risk limit exceeded\n" +
+		"guard clause \"manual override\" failed: manual override exceeded"
+	if err.Error() != expect {
+		t.Errorf("expected error:\n%s\ngot:\n%s", expect, err)
+	}
+}
+
+func TestGuardCombinators(t *testing.T) {
+	const trigGo Trigger = "go"
+	var fresh, limit, halted bool
+	guard := func(label string, ok *bool) GuardClause[int] {
+		return NewGuard(label, func(context.Context, int) error {
+			if !*ok {
+				return errors.New("false")
+			}
+			return nil
+		})
+	}
+	expr := Or(guard("fresh", &fresh), And(guard("limit", &limit), Not(guard("halted", &halted))))
+	const expectLabel = "fresh or (limit and not halted)"
+	if expr.String() != expectLabel {
+		t.Errorf("expected label %q, got %q", expectLabel, expr.String())
+	}
+	if len(expr.Operands()) != 2 || expr.Operands()[1].String() != "limit and not halted" {
+		t.Errorf("expected nested operands, got %v", expr.Operands())
+	}
+	if Not(All(guard("a", &fresh), guard("b", &fresh))).String() != "not (a and b)" {
+		t.Error("expected negated composite guard clause to be parenthesized")
+	}
+
+	var (
+		a = NewState("a", 0)
+		b = NewState("b", 0)
+	)
+	a.Permit(trigGo, b, expr)
+	sm := NewStateMachine(a)
+	for _, test := range []struct {
+		fresh, limit, halted bool
+		permitted            bool
+	}{
+		{fresh: true, permitted: true},
+		{limit: true, permitted: true},
+		{limit: true, halted: true},
+		{},
+	} {
+		fresh, limit, halted = test.fresh, test.limit, test.halted
+		err := sm.ExplainTriggers(context.Background(), 0)[trigGo]
+		if (err == nil) != test.permitted {
+			t.Errorf("fresh=%v limit=%v halted=%v: expected permitted=%v, got error %v", fresh, limit, halted, test.permitted, err)
+		}
+	}
+	limit, halted = true, true
+	err := sm.FireBg(trigGo, 0)
+	var guardErr *GuardClauseError
+	if !errors.As(err, &guardErr) || guardErr.Label != expectLabel || !errors.Is(err, ErrNegatedGuardPassed) {
+		t.Errorf("expected structured guard clause error, got %v", err)
+	}
+	const expectErr = `guard clause "fresh or (limit and not halted)" failed: guard clause "fresh" failed: false
+guard clause "limit and not halted" failed: guard clause "not halted" failed: negated guard clause passed`
+	if err.Error() != expectErr {
+		t.Errorf("expected error:\n%s\ngot:\n%s", expectErr, err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := WriteDOT(&buf, sm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `[`+expectLabel+`]`) {
+		t.Errorf("expected guard expression in DOT output:\n%s", buf.String())
+	}
+	buf.Reset()
+	writeMermaidStateDiagram(&buf, sm, diagConfig{})
+	if !strings.Contains(buf.String(), `:go [`+expectLabel+`]`) {
+		t.Errorf("expected guard expression in mermaid output:\n%s", buf.String())
+	}
+}
+
+// labels returns the labels of states.
+func labels(states []*State[int]) (l []string) {
+	for _, s := range states {
+		l = append(l, s.Label())
+	}
+	return l
+}
+
+// fakeClock is a Clock whose timers fire when advanced.
+type fakeClock struct {
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Duration
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	timer := &fakeTimer{at: c.now + d, f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (t *fakeTimer) Stop() bool {
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Advance moves the clock forward by d firing due timers in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now += d
+	for _, timer := range c.timers {
+		if !timer.stopped && timer.at <= c.now {
+			timer.stopped = true
+			timer.f()
+		}
+	}
+}
+
+func TestAfter(t *testing.T) {
+	const (
+		trigPay     Trigger = "pay"
+		trigAdvance Trigger = "advance"
+		trigTimeout Trigger = "timeout"
+	)
+	var (
+		closed = NewState("closed", 0)
+		open   = NewState("open", 0)
+	)
+	closed.Permit(trigPay, open)
+	open.Permit(trigAdvance, closed)
+	open.Permit(trigTimeout, closed)
+	open.After(30*time.Second, trigTimeout)
+
+	sm := NewStateMachine(closed)
+	clock := &fakeClock{}
+	sm.SetClock(clock)
+	ssm := NewSyncStateMachine(sm)
+	var timeouts int
+	open.OnExitThrough(trigTimeout, NewFringeCallback("timeout", func(_ context.Context, _ intTransition, _ int) {
+		timeouts++
+	}))
+
+	ssm.FireBg(trigPay, 0)
+	clock.Advance(20 * time.Second)
+	ssm.FireBg(trigAdvance, 0) // Timer stopped on exit.
+	clock.Advance(20 * time.Second)
+	if timeouts != 0 || ssm.State() != closed {
+		t.Errorf("expected stopped timer not to fire, got %d timeouts in state %s", timeouts, ssm.StateLabel())
+	}
+	ssm.FireBg(trigPay, 0)
+	clock.Advance(29 * time.Second)
+	if ssm.State() != open {
+		t.Errorf("expected state %s before timeout, got %s", open.Label(), ssm.StateLabel())
+	}
+	clock.Advance(time.Second)
+	if timeouts != 1 || ssm.State() != closed {
+		t.Errorf("expected timeout, got %d timeouts in state %s", timeouts, ssm.StateLabel())
+	}
+
+	var buf bytes.Buffer
+	_, err := WriteDOT(&buf, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const edge = `"open" -> "closed" [ label = "timeout\nafter(30s)", style = "solid" ]`
+	if !bytes.Contains(buf.Bytes(), []byte(edge)) {
+		t.Errorf("expected %s in DOT output:\n%s", edge, buf.String())
+	}
+}
+
+func Example_mermaid() {
 	const (
 		PARENT   = 0
 		SUPER    = 4
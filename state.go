@@ -1,6 +1,7 @@
 package maquina
 
 import (
+	"context"
 	"errors"
 )
 
@@ -14,9 +15,39 @@ type State[T input] struct {
 	exitFuncs    []triggeredFunc[T]
 	entryFuncs   []triggeredFunc[T]
 	reentryFuncs []triggeredFunc[T]
+	ignored      []Trigger
+	deferred     []Trigger
+	automatic    []Transition[T]
 	parent       *State[T]
+	initial      *State[T]
+	history      History
+	regions      []*State[T]
+	// choice is set for choice pseudo-states, which branch to one of branches.
+	choice     bool
+	branches   []Transition[T]
+	final      bool
+	timers     []stateTimer
+	activities []stateActivity[T]
+	// resumes is set for history pseudo-states, which resume the history of parent.
+	resumes        History
+	shallowHistory *State[T]
+	deepHistory    *State[T]
 }
 
+// History specifies which substate a superstate resumes in when it is
+// re-entered. See [State.SetHistory], [State.ShallowHistory] and [State.DeepHistory].
+type History uint8
+
+const (
+	// HistoryNone is the default. Entering a superstate descends into its initial substate.
+	HistoryNone History = iota
+	// HistoryShallow resumes in the direct substate that was last active.
+	// The descent continues from it as if it were entered normally.
+	HistoryShallow
+	// HistoryDeep resumes in the innermost substate that was last active.
+	HistoryDeep
+)
+
 // NewState instantiates a state with a label for tracking and tracing.
 // The type parameter T will be the argument received by entry, exit,
 // reentry and guard clause callbacks during state transitions.
@@ -32,11 +63,141 @@ func NewState[T input](label string, _ T) *State[T] {
 	}
 }
 
+// NewChoice instantiates a choice pseudo-state with a label for tracking and tracing.
+// A choice is a transient branch point: a transition with a choice as destination
+// ends in the destination of the first branch of the choice whose guard clauses
+// return true, evaluated in order of registration with the input passed to Fire.
+// Branches are registered with [State.Branch]. The state machine never rests in a
+// choice and no callbacks of the choice are run.
+//
+// Branches are evaluated after the guard clauses of the transition and before
+// [StateMachine.OnTransitioning] is invoked and the source state is exited.
+// If no branch is permitted the transition is aborted and Fire returns the errors
+// of the guard clauses. Choices should therefore have an else branch with no guard
+// clauses, which [StateMachine.Validate] checks for.
+func NewChoice[T input](label string, _ T) *State[T] {
+	var zero T
+	s := NewState(label, zero)
+	s.choice = true
+	return s
+}
+
+// SetFinal marks s as a final state. A final state may not have transitions nor
+// substates. A state machine which reaches a final state that is not a substate
+// is done, see [StateMachine.Done]. A superstate is completed once one of its
+// substates, or one substate in each of its regions, is a final state it rests in;
+// it then takes its transition registered for TriggerDone, if any. SetFinal panics
+// if s has transitions or substates to descend into.
+func (s *State[T]) SetFinal() {
+	if len(s.transitions) > 0 || len(s.automatic) > 0 {
+		panic("final state " + s.label + " cannot have transitions")
+	}
+	if s.descends() || s.choice {
+		panic("final state " + s.label + " must be a simple state")
+	}
+	s.final = true
+}
+
+// IsFinal returns true if s has been marked as final with SetFinal.
+func (s *State[T]) IsFinal() bool { return s.final }
+
+// IsChoice returns true if s is a choice pseudo-state created with NewChoice.
+func (s *State[T]) IsChoice() bool { return s.choice }
+
+// Branch registers a branch from the receiver choice s to dst taken when the guard
+// clauses return true. A branch with no guard clauses is the else branch, which
+// must be registered last. Branch panics if s is not a choice or if s already has
+// an else branch.
+func (s *State[T]) Branch(dst *State[T], guards ...GuardClause[T]) {
+	if !s.choice {
+		panic("state " + s.label + " is not a choice")
+	}
+	if dst == nil {
+		panic("nil destination state")
+	}
+	if statesEqual(s, dst) {
+		panic("choice " + s.label + " cannot branch to itself")
+	}
+	if s.hasElse() {
+		panic("choice " + s.label + " already has an else branch")
+	}
+	s.branches = append(s.branches, Transition[T]{Src: s, Dst: dst, guards: guards})
+}
+
+// hasElse returns true if the choice s has a branch with no guard clauses.
+func (s *State[T]) hasElse() bool {
+	return len(s.branches) > 0 && !s.branches[len(s.branches)-1].HasGuards()
+}
+
+// selectBranch returns the destination of the first permitted branch of the choice s.
+func (s *State[T]) selectBranch(ctx context.Context, input T, site *callSite) (*State[T], error) {
+	var errs []error
+	for i := range s.branches {
+		err := s.branches[i].isPermitted(ctx, input, site)
+		if err == nil {
+			return s.branches[i].Dst, nil
+		}
+		errs = append(errs, err)
+	}
+	errs = append([]error{errors.New("no branch of choice \"" + s.label + "\" permitted")}, errs...)
+	return nil, joinErrors(errs)
+}
+
 // Label returns the label with which the state was created. Does not heap allocate.
 func (s *State[T]) Label() string { return s.label }
 
 // LinkSubstates links argument states as substates of the receiver state s.
 func (s *State[T]) LinkSubstates(substates ...*State[T]) error {
+	if len(s.regions) > 0 {
+		return errors.New("state " + s.Label() + " has orthogonal regions, link substates to its regions")
+	}
+	return s.linkSubstates(substates)
+}
+
+// LinkRegions links argument states as orthogonal regions of the receiver state s.
+// Once s is entered each of its regions is entered and descended into, so that the
+// state machine is in one substate of every region at the same time. Regions
+// usually have an initial substate set with SetInitialSubstate.
+//
+// A trigger fired within s is dispatched to every region that handles it. If a
+// region takes a transition that leaves s, all regions are exited along with s.
+func (s *State[T]) LinkRegions(regions ...*State[T]) error {
+	if s.initial != nil {
+		return errors.New("state " + s.Label() + " has an initial substate and cannot have orthogonal regions")
+	}
+	if err := s.linkSubstates(regions); err != nil {
+		return err
+	}
+	s.regions = append(s.regions, regions...)
+	return nil
+}
+
+// Regions returns the orthogonal regions of s linked with LinkRegions.
+func (s *State[T]) Regions() []*State[T] {
+	return append([]*State[T]{}, s.regions...)
+}
+
+// descends returns true if entering s descends into its initial substate or
+// regions, in which case the state machine never rests in s.
+func (s *State[T]) descends() bool { return s.initial != nil || len(s.regions) > 0 }
+
+// isRegion returns true if s is an orthogonal region of its parent.
+func (s *State[T]) isRegion() bool {
+	if s.parent == nil {
+		return false
+	}
+	for _, region := range s.parent.regions {
+		if statesEqual(region, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State[T]) linkSubstates(substates []*State[T]) error {
+	if s.final {
+		return errors.New("final state " + s.Label() + " cannot have substates")
+	}
 	for i := range substates {
 		if substates[i] == nil {
 			return errors.New("cannot link nil state")
@@ -52,6 +213,77 @@ func (s *State[T]) LinkSubstates(substates ...*State[T]) error {
 	return nil
 }
 
+// SetInitialSubstate sets the substate the state machine descends into when
+// entering the receiver superstate s. The substate must have been linked to s
+// with LinkSubstates beforehand. If the initial substate is itself a superstate
+// with an initial substate the descent continues recursively, running the entry
+// callbacks of each substate entered along the way.
+func (s *State[T]) SetInitialSubstate(substate *State[T]) error {
+	if substate == nil {
+		return errors.New("cannot set nil initial substate")
+	}
+	if substate.parent != s || substate.resumes != HistoryNone {
+		return errors.New("state " + substate.Label() + " is not a substate of " + s.Label())
+	}
+	if len(s.regions) > 0 {
+		return errors.New("state " + s.Label() + " has orthogonal regions and cannot have an initial substate")
+	}
+	s.initial = substate
+	return nil
+}
+
+// SetHistory sets the history kind of the superstate s. When a superstate with
+// history is exited the state machine records the substate it was in. Transitions
+// that target s then resume in the recorded substate instead of descending into
+// the initial substate. If no substate has been recorded yet the initial
+// substate is entered. Use [StateMachine.History] to inspect the recorded substate.
+// To choose per transition whether s is resumed, leave the history kind of s unset
+// and target [State.ShallowHistory] or [State.DeepHistory] where s should resume.
+func (s *State[T]) SetHistory(h History) {
+	if h > HistoryDeep {
+		panic("invalid history kind")
+	}
+	s.history = h
+}
+
+// ShallowHistory returns the shallow history pseudo-state of the superstate s.
+// A transition targeting it resumes s in the direct substate that was last active,
+// descending from it as if it were entered normally, while transitions targeting s
+// descend into its initial substate unless s has a history kind set. If s has not
+// been exited yet the transition enters s as if targeting it. The state machine
+// never rests in a history pseudo-state and no callbacks of it are run.
+func (s *State[T]) ShallowHistory() *State[T] { return s.historyState(HistoryShallow) }
+
+// DeepHistory returns the deep history pseudo-state of the superstate s. A
+// transition targeting it resumes s in the innermost substates that were last
+// active, one in each orthogonal region. See [State.ShallowHistory].
+func (s *State[T]) DeepHistory() *State[T] { return s.historyState(HistoryDeep) }
+
+// historyState returns the history pseudo-state of s of kind h, creating it on first use.
+func (s *State[T]) historyState(h History) *State[T] {
+	if s.resumes != HistoryNone || s.choice {
+		panic("pseudo-state " + s.label + " has no history")
+	}
+	ps, label := &s.shallowHistory, s.label+" (H)"
+	if h == HistoryDeep {
+		ps, label = &s.deepHistory, s.label+" (H*)"
+	}
+	if *ps == nil {
+		*ps = &State[T]{label: label, parent: s, resumes: h}
+	}
+	return *ps
+}
+
+// recordsHistory returns true if the state machine records the history of s
+// when exiting it.
+func (s *State[T]) recordsHistory() bool {
+	return s.history != HistoryNone || s.shallowHistory != nil || s.deepHistory != nil
+}
+
+// InitialSubstate returns the initial substate of s set with SetInitialSubstate
+// or nil if it has none.
+func (s *State[T]) InitialSubstate() *State[T] { return s.initial }
+
 // isSubstateOf returns true if the receiver state s is a substate of the given
 // maybeParent state or if states are equal to each other.
 func (s *State[T]) isSubstateOf(maybeParent *State[T]) bool {
@@ -87,6 +319,15 @@ func (s State[T]) String() (str string) {
 // invoked given the guard clauses return true. If any of the guard clauses return
 // false the state transition is aborted and the Fire() attempt by the state machine
 // returns an error.
+//
+// Several transitions may be registered for the same trigger, each with its
+// own guard clauses. When the trigger is fired the first transition permitted
+// in order of registration is taken. A transition with no guard clauses may be
+// registered last as a fallback; Permit panics if a transition is registered for
+// a trigger which already has a transition with no guard clauses.
+//
+// Transitions permitted on a superstate are inherited by all its substates
+// unless a substate permits a transition with the same trigger.
 func (s *State[T]) Permit(t Trigger, dst *State[T], guards ...GuardClause[T]) {
 	if dst == nil {
 		panic("nil destination state")
@@ -97,6 +338,143 @@ func (s *State[T]) Permit(t Trigger, dst *State[T], guards ...GuardClause[T]) {
 	})
 }
 
+// PermitWithEffect registers a state transition from receiver s to dst like Permit
+// which additionally runs effect during the transition. The effect is run after
+// the exit callbacks of the states left and before the entry callbacks of the
+// states entered. On reentry the effect is run before the reentry callbacks.
+func (s *State[T]) PermitWithEffect(t Trigger, dst *State[T], effect FringeCallback[T], guards ...GuardClause[T]) {
+	if dst == nil {
+		panic("nil destination state")
+	}
+	if effect.cb == nil {
+		panic("nil transition effect")
+	}
+	s.validateForPermit(t)
+	s.transitions = append(s.transitions, Transition[T]{
+		Src: s, Dst: dst, Trigger: t, guards: guards, effect: effect,
+	})
+}
+
+// PermitAutomatic registers an automatic transition from receiver s to dst which is
+// taken without a trigger being fired when the guard clauses return true. Once a
+// fired trigger has been handled the automatic transitions of the states the state
+// machine rests in are evaluated in order of registration with the same input and
+// the first permitted is taken. This is repeated until no automatic transition is
+// permitted. Fire returns an AutomaticLoopError instead of entering a state already
+// rested in during the process.
+//
+// Automatic transitions have TriggerAutomatic as trigger. Those of a superstate
+// are evaluated while the state machine rests in any of its substates, after the
+// automatic transitions of the substates.
+func (s *State[T]) PermitAutomatic(dst *State[T], guards ...GuardClause[T]) {
+	if dst == nil {
+		panic("nil destination state")
+	}
+	if statesEqual(s, dst) {
+		panic("automatic transition from " + s.label + " to itself would loop")
+	}
+	if s.choice || s.final {
+		panic("state " + s.label + " cannot have automatic transitions")
+	}
+	s.automatic = append(s.automatic, Transition[T]{
+		Src: s, Dst: dst, Trigger: TriggerAutomatic, guards: guards,
+	})
+}
+
+// PermitDynamic registers a state transition from receiver s to the destination
+// chosen by selector when Trigger t is invoked given the guard clauses return true.
+// The selector is called after the guard clauses and before the OnTransitioning
+// callback so that all callbacks receive the transition with its destination set. If the
+// selector returns a state which is not one of its declared possible destinations
+// the transition is aborted and Fire returns an error.
+func (s *State[T]) PermitDynamic(t Trigger, selector DestinationSelector[T], guards ...GuardClause[T]) {
+	if selector.selector == nil {
+		panic("nil destination selector")
+	}
+	s.validateForPermit(t)
+	s.transitions = append(s.transitions, Transition[T]{
+		Src: s, Trigger: t, guards: guards, selector: selector,
+	})
+}
+
+// InternalTransition registers an internal transition on receiver s which runs
+// action when Trigger t is invoked given the guard clauses return true. The state
+// machine remains in its current state and no exit, entry or reentry callbacks
+// are run. Internal transitions registered on a superstate are inherited by its
+// substates like any other transition.
+func (s *State[T]) InternalTransition(t Trigger, action FringeCallback[T], guards ...GuardClause[T]) {
+	if action.cb == nil {
+		panic("nil internal transition action")
+	}
+	s.validateForPermit(t)
+	s.transitions = append(s.transitions, Transition[T]{
+		Src: s, Dst: s, Trigger: t, guards: guards, effect: action, internal: true,
+	})
+}
+
+// Ignore registers Trigger t as ignored by receiver s. Firing an ignored trigger
+// is a no-op: no callbacks are run and no error is returned. Triggers ignored by a
+// superstate are ignored by its substates unless a substate permits a transition
+// with the same trigger. Likewise a substate may ignore a trigger its superstate
+// permits. Ignore panics if s already has a transition registered for t or defers t.
+func (s *State[T]) Ignore(t Trigger) {
+	t.mustNotBeWildcard()
+	s.validateForHandling(t, handleIgnore)
+	if s.handling(t) == handleNone {
+		s.ignored = append(s.ignored, t)
+	}
+}
+
+// Defer registers Trigger t as deferred by receiver s. Firing a deferred trigger
+// stores it along with its input in the state machine's deferred queue instead
+// of handling it. Deferred triggers are fired again in order after each
+// transition that changes state, and are deferred once more if still deferred
+// by the new state. Triggers deferred by a superstate are deferred by its
+// substates unless a substate permits, ignores or defers the trigger itself.
+// Defer panics if s already has a transition registered for t or ignores t.
+// See [StateMachine.Deferred].
+func (s *State[T]) Defer(t Trigger) {
+	t.mustNotBeWildcard()
+	s.validateForHandling(t, handleDefer)
+	if s.handling(t) == handleNone {
+		s.deferred = append(s.deferred, t)
+	}
+}
+
+func (s *State[T]) validateForHandling(t Trigger, h handling) {
+	if tr := s.getTransition(t); tr != nil {
+		panic("trigger " + t.Quote() + " already registered as transition: " + tr.String())
+	}
+	if existing := s.handling(t); existing != handleNone && existing != h {
+		panic("trigger " + t.Quote() + " already registered as " + existing.String() + " by state " + s.label)
+	}
+}
+
+// handling returns how s itself handles t if s ignores or defers it.
+func (s *State[T]) handling(t Trigger) handling {
+	for _, ignored := range s.ignored {
+		if ignored == t {
+			return handleIgnore
+		}
+	}
+	for _, deferred := range s.deferred {
+		if deferred == t {
+			return handleDefer
+		}
+	}
+	return handleNone
+}
+
+func (h handling) String() string {
+	switch h {
+	case handleIgnore:
+		return "ignored"
+	case handleDefer:
+		return "deferred"
+	}
+	return "unhandled"
+}
+
 // OnEntryFrom registers a callback that executes on entering State s
 // through Trigger t. Does not execute on reentry.
 func (s *State[T]) OnEntryFrom(t Trigger, fcb FringeCallback[T]) {
@@ -178,14 +556,29 @@ func (s *State[T]) hasTransition(t Trigger) bool {
 	return false
 }
 
-// isSink returns true if the state has no outgoing transitions.
+// isSink returns true if the state has no outgoing transitions, including
+// those inherited from its superstates.
 func (s *State[T]) isSink() bool {
-	for i := 0; i < len(s.transitions); i++ {
-		if !statesEqual(s, s.transitions[i].Dst) {
+	if s.descends() || len(s.branches) > 0 || s.resumes != HistoryNone {
+		return false
+	}
+	for super := s; super != nil; super = super.parent {
+		if len(super.automatic) > 0 {
 			return false
 		}
 	}
-	return true
+	err := s.forEachTransition(func(tr *Transition[T]) error {
+		if tr.internal {
+			return nil // Never leaves the state.
+		}
+		for _, dst := range tr.destinations() {
+			if !statesEqual(s, dst) {
+				return errBreak
+			}
+		}
+		return nil
+	})
+	return err == nil
 }
 
 func (s *State[T]) onExitInternal(t Trigger, fcb FringeCallback[T]) {
@@ -218,13 +611,42 @@ func (s *State[T]) onEntryInternal(t Trigger, f FringeCallback[T]) {
 	})
 }
 
+// errBreak is used to stop iteration over states and transitions early.
+var errBreak = errors.New("break")
+
 var errTriggerWildcardNotAllowed = errors.New("trigger " + triggerWildcard.Quote() + " reserved for internal use (wildcard)")
 
 func (s *State[T]) validateForPermit(t Trigger) {
 	t.mustNotBeWildcard()
-	existingTransition := s.getTransition(t)
-	if existingTransition != nil {
-		panic("trigger " + t.Quote() + " already registered as transition: " + existingTransition.String())
+	if t == TriggerAutomatic {
+		panic("automatic transitions must be registered with PermitAutomatic")
+	}
+	if t == TriggerFault {
+		panic("cannot register transition for " + t.Quote() + " trigger")
+	}
+	if s.choice {
+		panic("choice " + s.label + " cannot have transitions, register branches instead")
+	}
+	if s.final {
+		panic("final state " + s.label + " cannot have transitions")
+	}
+	if h := s.handling(t); h != handleNone {
+		panic("trigger " + t.Quote() + " already registered as " + h.String() + " by state " + s.label)
+	}
+	for i := 0; i < len(s.transitions); i++ {
+		existing := s.transitions[i]
+		if existing.Trigger == t && !existing.HasGuards() {
+			panic("trigger " + t.Quote() + " already registered as unguarded transition: " + existing.String())
+		}
+	}
+}
+
+// mustNotBeReserved panics if t is the wildcard trigger or a trigger fired only by
+// the state machine itself, which therefore cannot be fired by timers or activities.
+func (t Trigger) mustNotBeReserved() {
+	t.mustNotBeWildcard()
+	if t == TriggerAutomatic || t == TriggerDone || t == TriggerFault {
+		panic("trigger " + t.Quote() + " reserved for internal use")
 	}
 }
 
@@ -2,34 +2,417 @@ package maquina
 
 import (
 	"context"
+	"errors"
+	"runtime/debug"
+	"time"
 )
 
-// StateMachine handles state transitioning control flow. Is not yet concurrency safe
-// nor may it ever be concurrent safe since this would probably be implemented in
-// a type that embeds StateMachine.
+// StateMachine handles state transitioning control flow. It is not concurrency safe;
+// use SyncStateMachine to share a state machine between goroutines.
 type StateMachine[T input] struct {
-	actual             *State[T]
+	start  *State[T]
+	actual *State[T]
+	// leaves contains the active innermost states. It contains a single state,
+	// actual, unless the state machine is within orthogonal regions.
+	leaves             []*State[T]
 	onFringe           func(tr Transition[T], fcb FringeCallback[T], input T)
 	onUnhandledTrigger func(s *State[T], t Trigger) error
 	onTransitioning    FringeCallback[T]
 	onTransitioned     FringeCallback[T]
+	onDone             FringeCallback[T]
+	// history maps superstate labels to the substate recorded on exit.
+	history map[string][]*State[T]
+	// rejectAmbiguous makes Fire return AmbiguousTransitionError when more than
+	// one transition is permitted for a trigger.
+	rejectAmbiguous bool
+	// panicOnUnhandled makes Fire panic on unhandled triggers instead of
+	// returning UnhandledTriggerError.
+	panicOnUnhandled bool
+	// firing is set while a transition is in progress. Triggers fired during
+	// a transition are added to queue and processed once it completes.
+	firing bool
+	queue  []queuedTrigger[T]
+	// next is the index in queue of the next trigger to process.
+	next int
+	// deferred contains triggers deferred by the current state in the order fired.
+	deferred []queuedTrigger[T]
+	// changed is set when a transition that changes state is taken.
+	changed bool
+	// clock starts the timers of states entered. Real time is used if nil.
+	clock Clock
+	// async runs triggers fired by timers and activities. They are run directly if nil.
+	async       func(fire func())
+	timers      []activeTimer[T]
+	timerSeq    uint64
+	activities  []runningActivity[T]
+	activitySeq uint64
+	// stopped contains the done channels of the activities stopped while
+	// waitStopped is set, which are waited on by the SyncStateMachine wrapping sm
+	// once its lock is released.
+	stopped     []chan struct{}
+	waitStopped bool
+	// root is the context state contexts derive from. context.Background() is used if nil.
+	root context.Context
+	// contexts contains the contexts of active states created so far.
+	contexts []stateContext[T]
+	// entering is the state whose entry callbacks are running, which is active
+	// along with its superstates before being added to leaves.
+	entering *State[T]
+	// journal records the transition in progress so that it may be rolled back.
+	journal journal[T]
+	// site is the guard clause or callback being run, recorded for panic recovery.
+	site        callSite
+	panicPolicy PanicPolicy
+	fault       *State[T]
+	// result records what the ongoing call to FireWithResult did if set.
+	result *FireResult[T]
+	// dryRun is set while planning a transition. Callbacks are recorded instead of
+	// run and transitions are rolled back once planned. See [StateMachine.Plan].
+	dryRun bool
 }
 
-// NewStateMachine returns a StateMachine with initial State s.
+type stateContext[T input] struct {
+	state  *State[T]
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type queuedTrigger[T input] struct {
+	ctx   context.Context
+	t     Trigger
+	input T
+}
+
+// NewStateMachine returns a StateMachine with initial State s. The state machine
+// starts in s without entering it, so NewStateMachine panics if s or one of its
+// superstates declares timers or activities, which would never be started.
 func NewStateMachine[T input](s *State[T]) *StateMachine[T] {
 	if s == nil {
 		panic("nil initial state")
 	}
+	if s.resumes != HistoryNone {
+		panic("initial state cannot be a history pseudo-state")
+	}
+	if s.choice {
+		panic("initial state cannot be a choice")
+	}
+	for super := s; super != nil; super = super.parent {
+		if len(super.timers) > 0 || len(super.activities) > 0 {
+			panic("initial state " + s.label + " would not start the timers or activities of " + super.label)
+		}
+	}
 	return &StateMachine[T]{
+		start:  s,
 		actual: s,
+		leaves: []*State[T]{s},
 	}
 }
 
-// State returns the current state.
+// State returns the current state. When the state machine is within orthogonal
+// regions the current state is the innermost state containing the active state
+// of every region. See [StateMachine.Configuration].
 func (sm *StateMachine[T]) State() *State[T] {
 	return sm.actual
 }
 
+// Configuration returns the active innermost states of the state machine.
+// It contains the current state only, unless the state machine is within
+// orthogonal regions, in which case it contains the active state of each region.
+func (sm *StateMachine[T]) Configuration() []*State[T] {
+	return append([]*State[T]{}, sm.leaves...)
+}
+
+// History returns the substate recorded when the superstate s was last exited
+// if s has history enabled. It returns nil if s has no history or if no substate
+// has been recorded yet. If deep history recorded the active states of several
+// orthogonal regions the innermost state containing them is returned and the
+// recorded states are those returned by [StateMachine.HistoryConfiguration].
+// See [State.SetHistory].
+func (sm *StateMachine[T]) History(s *State[T]) *State[T] {
+	recorded := sm.HistoryConfiguration(s)
+	if len(recorded) == 0 {
+		return nil
+	}
+	return commonAncestor(recorded)
+}
+
+// HistoryConfiguration returns the substates recorded when the superstate s was
+// last exited if s has history enabled. Deep history records the active state of
+// each orthogonal region within s. It returns nil if s has no history or if no
+// substate has been recorded yet.
+func (sm *StateMachine[T]) HistoryConfiguration(s *State[T]) []*State[T] {
+	if !s.recordsHistory() {
+		return nil
+	}
+	return append([]*State[T](nil), sm.history[s.label]...)
+}
+
+// DispatchAsync sets the hook through which triggers fired asynchronously by
+// expired timers and failed activities are fired on the state machine. The
+// dispatch function must call fire when it is safe to do so, i.e: after acquiring
+// a lock or from within the goroutine that owns the state machine. By default fire
+// is called directly from the timer's or activity's goroutine. NewSyncStateMachine
+// sets a dispatch hook which acquires its lock.
+func (sm *StateMachine[T]) DispatchAsync(dispatch func(fire func())) {
+	sm.async = dispatch
+}
+
+// runAsync runs fire through the dispatch hook set with DispatchAsync.
+func (sm *StateMachine[T]) runAsync(fire func()) {
+	if sm.async != nil {
+		sm.async(fire)
+	} else {
+		fire()
+	}
+}
+
+// SetRootContext sets the context from which the contexts of states are derived.
+// Cancelling root cancels the contexts of all states. It does not affect state
+// contexts already created. See [StateMachine.StateContext].
+func (sm *StateMachine[T]) SetRootContext(root context.Context) {
+	if root == nil {
+		panic("nil root context")
+	}
+	sm.root = root
+}
+
+// StateContext returns the context of the active state s which is cancelled once
+// s is exited. It is derived from the context of the superstate of s, or from the
+// root context if s is not a substate. It is meant to be used from within
+// callbacks to bound the lifetime of work started on entering s:
+//
+//	s.OnEntry(maquina.NewFringeCallback("poll", func(_ context.Context, _ Transition[T], input T) {
+//		go poll(sm.StateContext(s), input) // Stops once s is exited.
+//	}))
+//
+// Contexts are created on first use. If s is not active an already cancelled
+// context is returned.
+func (sm *StateMachine[T]) StateContext(s *State[T]) context.Context {
+	for _, sc := range sm.contexts {
+		if statesEqual(sc.state, s) {
+			return sc.ctx
+		}
+	}
+	if !sm.isActive(s) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	parent := sm.root
+	if s.parent != nil {
+		parent = sm.StateContext(s.parent)
+	} else if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	sm.contexts = append(sm.contexts, stateContext[T]{state: s, ctx: ctx, cancel: cancel})
+	return ctx
+}
+
+// isActive returns true if s is an active state or contains one.
+func (sm *StateMachine[T]) isActive(s *State[T]) bool {
+	if sm.entering != nil && s.Contains(sm.entering) {
+		return true
+	}
+	for _, leaf := range sm.leaves {
+		if s.Contains(leaf) {
+			return true
+		}
+	}
+	return false
+}
+
+// suspendStateContext moves the context of the exited state s, if it was created,
+// to the journal. It is cancelled once the transition completes or restored if
+// the transition is rolled back.
+func (sm *StateMachine[T]) suspendStateContext(s *State[T]) {
+	for i, sc := range sm.contexts {
+		if statesEqual(sc.state, s) {
+			sm.journal.contexts = append(sm.journal.contexts, sc)
+			sm.contexts = append(sm.contexts[:i], sm.contexts[i+1:]...)
+			return
+		}
+	}
+}
+
+// cancelStateContext cancels the context of the exited state s if it was created.
+func (sm *StateMachine[T]) cancelStateContext(s *State[T]) {
+	for i, sc := range sm.contexts {
+		if statesEqual(sc.state, s) {
+			sc.cancel()
+			sm.contexts = append(sm.contexts[:i], sm.contexts[i+1:]...)
+			return
+		}
+	}
+}
+
+// Snapshot is a representation of the current state and recorded history of a
+// StateMachine which may be persisted and later restored with [StateMachine.Restore].
+// States are referenced by their labels.
+type Snapshot struct {
+	// State is the label of the current state.
+	State string
+	// Configuration contains the labels of the active state of each orthogonal
+	// region when the state machine is within orthogonal regions. It is empty otherwise.
+	Configuration []string
+	// History maps labels of superstates with history to the label of their recorded substate.
+	History map[string]string
+	// HistoryConfiguration maps labels of superstates with deep history which
+	// recorded the active states of several orthogonal regions to the labels of
+	// those states. History then contains the innermost state containing them.
+	HistoryConfiguration map[string][]string
+}
+
+// Snapshot returns a snapshot of the current state and recorded history of sm.
+func (sm *StateMachine[T]) Snapshot() Snapshot {
+	snap := Snapshot{State: sm.actual.label}
+	if len(sm.leaves) > 1 {
+		for _, leaf := range sm.leaves {
+			snap.Configuration = append(snap.Configuration, leaf.label)
+		}
+	}
+	if len(sm.history) > 0 {
+		snap.History = make(map[string]string, len(sm.history))
+		for label, recorded := range sm.history {
+			snap.History[label] = commonAncestor(recorded).label
+			if len(recorded) == 1 {
+				continue
+			}
+			if snap.HistoryConfiguration == nil {
+				snap.HistoryConfiguration = make(map[string][]string)
+			}
+			for _, s := range recorded {
+				snap.HistoryConfiguration[label] = append(snap.HistoryConfiguration[label], s.label)
+			}
+		}
+	}
+	return snap
+}
+
+// Restore sets the current state and recorded history of sm to those of snap
+// without running any callbacks. States are looked up by label among the states
+// reachable from the initial and current state of sm and their superstates.
+// Active timers and activities are stopped and those of the restored states are
+// not started. State contexts created are cancelled.
+// If an error is returned sm is left unmodified.
+func (sm *StateMachine[T]) Restore(snap Snapshot) error {
+	states := make(map[string]*State[T])
+	collect := func(s *State[T]) error {
+		for ; s != nil; s = s.parent {
+			states[s.label] = s
+		}
+		return nil
+	}
+	WalkStates(sm.start, collect)
+	WalkStates(sm.actual, collect)
+	actual := states[snap.State]
+	if actual == nil {
+		return errors.New("snapshot state \"" + snap.State + "\" not found")
+	}
+	leaves := []*State[T]{actual}
+	if len(snap.Configuration) > 0 {
+		leaves = leaves[:0]
+		for _, label := range snap.Configuration {
+			leaf := states[label]
+			if leaf == nil || !actual.Contains(leaf) {
+				return errors.New("invalid snapshot configuration state \"" + label + "\"")
+			}
+			leaves = append(leaves, leaf)
+		}
+	}
+	if !covers(actual, leaves) || commonAncestor(leaves) != actual {
+		return errors.New("snapshot configuration does not cover every orthogonal region of \"" + snap.State + "\"")
+	}
+	var history map[string][]*State[T]
+	for superLabel, subLabel := range snap.History {
+		subLabels := snap.HistoryConfiguration[superLabel]
+		if len(subLabels) == 0 {
+			subLabels = []string{subLabel}
+		}
+		super := states[superLabel]
+		var recorded []*State[T]
+		for _, label := range subLabels {
+			sub := states[label]
+			if super == nil || sub == nil || !below(sub, super) {
+				return errors.New("invalid snapshot history \"" + label + "\" for superstate \"" + superLabel + "\"")
+			}
+			recorded = append(recorded, sub)
+		}
+		if ancestor := commonAncestor(recorded); ancestor.label != subLabel || !covers(ancestor, recorded) {
+			return errors.New("invalid snapshot history \"" + subLabel + "\" for superstate \"" + superLabel + "\"")
+		}
+		if history == nil {
+			history = make(map[string][]*State[T], len(snap.History))
+		}
+		history[superLabel] = recorded
+	}
+	for superLabel := range snap.HistoryConfiguration {
+		if _, ok := snap.History[superLabel]; !ok {
+			return errors.New("snapshot history configuration for superstate \"" + superLabel + "\" has no history")
+		}
+	}
+	for _, at := range sm.timers {
+		at.timer.Stop()
+	}
+	sm.timers = nil
+	for _, ra := range sm.activities {
+		ra.cancel()
+		if sm.waitStopped {
+			sm.stopped = append(sm.stopped, ra.done)
+		} else {
+			<-ra.done
+		}
+	}
+	sm.activities = nil
+	for _, sc := range sm.contexts {
+		sc.cancel()
+	}
+	sm.contexts = nil
+	sm.actual = actual
+	sm.leaves = leaves
+	sm.history = history
+	return nil
+}
+
+// covers returns true if leaves contains exactly one leaf state within every
+// orthogonal region below s, or s itself if it is the only leaf.
+func covers[T input](s *State[T], leaves []*State[T]) bool {
+	if len(s.regions) > 0 {
+		n := 0
+		for _, region := range s.regions {
+			var within []*State[T]
+			for _, leaf := range leaves {
+				if region.Contains(leaf) {
+					within = append(within, leaf)
+				}
+			}
+			if !covers(region, within) {
+				return false
+			}
+			n += len(within)
+		}
+		return n == len(leaves)
+	}
+	if len(leaves) == 0 || !s.Contains(leaves[0]) {
+		return false
+	} else if len(leaves) == 1 && statesEqual(leaves[0], s) {
+		return true
+	}
+	child := leaves[0]
+	for child != nil && child.parent != s {
+		child = child.parent
+	}
+	if child == nil {
+		return false
+	}
+	for _, leaf := range leaves[1:] {
+		if !child.Contains(leaf) {
+			return false
+		}
+	}
+	return covers(child, leaves)
+}
+
 // StateLabel returns the current state label. Is shorthand for sm.State().Label().
 // Is provided for convenience as a method to allow allow construction
 // of state machine interface types with no type parameters.
@@ -41,9 +424,11 @@ func (sm *StateMachine[T]) StateLabel() string { return sm.State().Label() }
 // FireBg returns an error in the following cases:
 //   - A guard clause fails to validate (returns GuardClauseError).
 //   - OnUnhandledTrigger registered callback catches an unhandled trigger and returns an error.
+//   - There is no registered trigger on the current state and the OnUnhandledTrigger
+//     callback has not been set (returns UnhandledTriggerError).
 //
-// FireBg panics if there is no registered trigger on the current state and the
-// OnUnhandledTrigger callback has not been set.
+// FireBg panics instead of returning UnhandledTriggerError if PanicOnUnhandledTrigger
+// has been enabled.
 func (sm *StateMachine[T]) FireBg(t Trigger, input T) error {
 	return sm.Fire(context.Background(), t, input)
 }
@@ -53,62 +438,750 @@ func (sm *StateMachine[T]) FireBg(t Trigger, input T) error {
 // Fire returns an error in the following cases:
 //   - ctx.Err() != nil (cancelled context) for the case where the context is cancelled
 //     before the exit/reentry functions are run.
-//   - A guard clause fails to validate (returns GuardClauseError).
+//   - A guard clause fails to validate (returns GuardClauseError). If several
+//     transitions are registered for the trigger and none is permitted the
+//     GuardClauseError of each transition is returned joined.
+//   - More than one transition is permitted for the trigger and RejectAmbiguousTransitions
+//     has been enabled (returns AmbiguousTransitionError).
 //   - OnUnhandledTrigger registered callback catches an unhandled trigger and returns an error.
+//   - There is no registered trigger on the current state and the OnUnhandledTrigger
+//     callback has not been set (returns UnhandledTriggerError).
+//   - A trigger fired from within a callback fails (returns QueuedTriggerError).
+//   - A fallible callback fails during the transition, which is rolled back
+//     (returns CallbackError). See [NewFallibleCallback].
+//   - A guard clause or callback panics and the panic is recovered according
+//     to the panic policy (returns PanicError). See [StateMachine.SetPanicPolicy].
+//
+// If Fire is called from within a callback while a transition is in progress
+// the trigger is queued and Fire returns nil immediately. Queued triggers are
+// processed in order once the ongoing transition completes (run-to-completion)
+// and their errors are returned by the outermost call to Fire. Triggers deferred
+// by the current state are processed likewise after the next change of state.
 //
-// Fire panics if there is no registered trigger on the current state and the
-// OnUnhandledTrigger callback has not been set.
+// Fire panics instead of returning UnhandledTriggerError if PanicOnUnhandledTrigger
+// has been enabled.
 func (sm *StateMachine[T]) Fire(ctx context.Context, t Trigger, input T) error {
-	if t == triggerWildcard {
-		panic("cannot fire wildcard trigger") // Panic since this would imply a bug in the code.
+	if t == triggerWildcard || t == TriggerAutomatic || t == TriggerDone || t == TriggerFault {
+		panic("cannot fire " + t.Quote() + " trigger") // Panic since this would imply a bug in the code.
 	}
-	transition := sm.actual.getTransition(t)
+	if sm.firing {
+		sm.queue = append(sm.queue, queuedTrigger[T]{ctx: ctx, t: t, input: input})
+		return nil
+	}
+	sm.firing = true
+	defer func() {
+		sm.firing = false
+		sm.queue = sm.queue[:0]
+		sm.next = 0
+	}()
+	err := sm.fireTrigger(ctx, t, input)
+	if len(sm.queue) == 0 {
+		return err
+	}
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	// Queue may grow as queued triggers are processed.
+	for sm.next < len(sm.queue) {
+		q := sm.queue[sm.next]
+		sm.queue[sm.next] = queuedTrigger[T]{} // Release references.
+		sm.next++
+		if err := sm.fireTrigger(q.ctx, q.t, q.input); err != nil {
+			errs = append(errs, &QueuedTriggerError{Trigger: q.t, err: err})
+		}
+	}
+	return joinErrors(errs)
+}
+
+// FireResult describes what a call to [StateMachine.FireWithResult] did.
+type FireResult[T input] struct {
+	// Transitions contains the transitions taken, in order, with their source and
+	// destination states set. The transition taken for the fired trigger is followed
+	// by automatic and completion transitions and those taken for queued and deferred
+	// triggers. It is empty if no transition was taken, i.e: the trigger was ignored,
+	// deferred or the transition failed.
+	Transitions []Transition[T]
+	// Exited contains the states exited by the transitions taken, innermost first.
+	Exited []*State[T]
+	// Entered contains the states entered by the transitions taken, outermost first.
+	Entered []*State[T]
+	// Callbacks contains the callbacks run in order, including those of transitions
+	// which failed and were rolled back.
+	Callbacks []CallbackRun
+}
+
+// Reentry returns true if the transition taken for the fired trigger was a reentry
+// transition, in which case no state was exited or entered.
+func (r FireResult[T]) Reentry() bool {
+	return len(r.Transitions) > 0 && r.Transitions[0].IsReentry() && !r.Transitions[0].IsInternal()
+}
+
+// CallbackRun records a callback run by a state machine during a transition.
+type CallbackRun struct {
+	// The label of the callback.
+	Label string
+	// The step of the transition in which the callback was run.
+	Phase Phase
+	// The label of the state the callback is registered on. For effects it is the
+	// label of the source state. It is empty for callbacks registered on the state machine.
+	State string
+	// Compensation is set if the callback is the compensation of a callback run
+	// before the transition was rolled back. See [FringeCallback.WithCompensation].
+	Compensation bool
+	// The time it took for the callback to return.
+	Duration time.Duration
+}
+
+// FireWithResult fires the state transition corresponding to the trigger t like
+// Fire and returns a FireResult describing the transitions taken and the callbacks
+// run. If FireWithResult is called from within a callback while a transition is in
+// progress the trigger is queued and the zero FireResult is returned; what it does
+// is then described by the result of the outermost call to FireWithResult, if any.
+func (sm *StateMachine[T]) FireWithResult(ctx context.Context, t Trigger, input T) (FireResult[T], error) {
+	if sm.firing {
+		return FireResult[T]{}, sm.Fire(ctx, t, input)
+	}
+	var result FireResult[T]
+	sm.result = &result
+	defer func() { sm.result = nil }()
+	err := sm.Fire(ctx, t, input)
+	return result, err
+}
+
+// recordCallback records a callback run during a transition if recording a result.
+func (sm *StateMachine[T]) recordCallback(label string, phase Phase, state *State[T], compensation bool, d time.Duration) {
+	run := CallbackRun{Label: label, Phase: phase, Compensation: compensation, Duration: d}
+	if state != nil {
+		run.State = state.label
+	}
+	sm.result.Callbacks = append(sm.result.Callbacks, run)
+}
+
+// runHook runs a callback registered on the state machine during the given phase of tr.
+func (sm *StateMachine[T]) runHook(ctx context.Context, tr Transition[T], phase Phase, hook FringeCallback[T], input T) {
+	if sm.dryRun {
+		sm.recordCallback(hook.label, phase, nil, false, 0)
+		return
+	}
+	sm.site = callSite{phase: phase, label: hook.label}
+	if sm.result == nil {
+		hook.cb(ctx, tr, input)
+		return
+	}
+	start := time.Now()
+	hook.cb(ctx, tr, input)
+	sm.recordCallback(hook.label, phase, nil, false, time.Since(start))
+}
+
+// Plan returns the FireResult that firing trigger t with input would produce
+// without running any callbacks nor changing the state of sm. Guard clauses,
+// destination selectors and choice branches are evaluated to select the transition
+// and its destination, and should therefore be free of side effects. The callbacks
+// that would be run are listed in order with no duration. Automatic and completion
+// transitions that would follow are not planned.
+//
+// Plan returns the errors Fire would return for guard clauses that fail. It returns
+// UnhandledTriggerError for unhandled triggers without calling the OnUnhandledTrigger
+// callback nor panicking. Ignored and deferred triggers yield an empty plan.
+// Plan may not be called from within a callback while a transition is in progress.
+func (sm *StateMachine[T]) Plan(ctx context.Context, t Trigger, input T) (FireResult[T], error) {
+	if t == triggerWildcard || t == TriggerAutomatic || t == TriggerDone || t == TriggerFault {
+		panic("cannot plan " + t.Quote() + " trigger")
+	}
+	if sm.firing {
+		return FireResult[T]{}, errors.New("cannot plan while a transition is in progress")
+	}
+	var result FireResult[T]
+	sm.result = &result
+	sm.dryRun = true
+	defer func() {
+		sm.result = nil
+		sm.dryRun = false
+	}()
+	err := sm.dispatch(ctx, t, input)
+	return result, err
+}
+
+// fireTrigger handles trigger t and takes the automatic transitions permitted
+// thereafter. Deferred triggers are released if the state changed.
+func (sm *StateMachine[T]) fireTrigger(ctx context.Context, t Trigger, input T) (err error) {
+	if sm.panicPolicy != PanicPropagate {
+		defer sm.recoverPanic(ctx, t, input, &err)
+	} else {
+		defer sm.unwindPanic(ctx)
+	}
+	sm.changed = false
+	err = sm.dispatch(ctx, t, input)
+	if !sm.changed {
+		return err
+	}
+	if autoErr := sm.settle(ctx, input); autoErr != nil {
+		if err == nil {
+			err = autoErr
+		} else {
+			err = joinErrors([]error{err, autoErr})
+		}
+	}
+	sm.releaseDeferred()
+	return err
+}
+
+func (sm *StateMachine[T]) dispatch(ctx context.Context, t Trigger, input T) error {
+	if len(sm.leaves) > 1 {
+		return sm.fireRegions(ctx, t, input)
+	}
+	transition, h := sm.actual.resolve(t)
 	if transition == nil {
-		if sm.onUnhandledTrigger != nil {
-			return sm.onUnhandledTrigger(sm.actual, t)
+		return sm.handle(ctx, t, input, h)
+	}
+	_, err := sm.fireTransition(ctx, sm.actual, transition, input)
+	return err
+}
+
+// settle takes the first permitted automatic transition of the active leaf states,
+// or completion transition of completed superstates, until none is permitted.
+// It returns AutomaticLoopError before entering a state already rested in.
+func (sm *StateMachine[T]) settle(ctx context.Context, input T) error {
+	var rested []*State[T]
+	for {
+		leaf, transition := sm.automaticTransition(ctx, input)
+		if transition == nil {
+			leaf, transition = sm.completionTransition(ctx, input)
+		}
+		if transition == nil {
+			return nil
+		}
+		if rested == nil {
+			rested = append(rested, sm.leaves...)
+		}
+		tr, err := sm.resolveDst(ctx, leaf, *transition, input)
+		if err != nil {
+			return err
+		}
+		for _, s := range sm.descentLeaves(nil, tr.Dst, sm.historyTargets(tr.Dst, tr.resume)) {
+			if !containsState(rested, s) {
+				continue
+			}
+			loop := &AutomaticLoopError{}
+			for _, s := range rested {
+				loop.Path = append(loop.Path, s.label)
+			}
+			loop.Path = append(loop.Path, s.label)
+			return loop
+		}
+		if _, err := sm.takeResolved(ctx, leaf, tr, input); err != nil {
+			return err
 		}
+		rested = append(rested, sm.leaves...)
+	}
+}
+
+// descentLeaves appends to dst the leaf states entered when descending into s
+// down to the recorded states targets, as done by descendTo.
+func (sm *StateMachine[T]) descentLeaves(dst []*State[T], s *State[T], targets []*State[T]) []*State[T] {
+	var within []*State[T]
+	for _, target := range targets {
+		if below(target, s) {
+			within = append(within, target)
+		}
+	}
+	if len(within) == 0 {
+		within = sm.historyTargets(s, s.history)
+	}
+	for _, region := range s.regions {
+		dst = sm.descentLeaves(dst, region, within)
+	}
+	switch {
+	case len(s.regions) > 0:
+		return dst
+	case len(within) > 0:
+		next := within[0]
+		for next.parent != s {
+			next = next.parent
+		}
+		return sm.descentLeaves(dst, next, within)
+	case s.initial != nil:
+		return sm.descentLeaves(dst, s.initial, nil)
+	}
+	return append(dst, s)
+}
+
+// automaticTransition returns the first permitted automatic transition of the
+// active leaf states and their superstates along with the leaf to take it from.
+func (sm *StateMachine[T]) automaticTransition(ctx context.Context, input T) (*State[T], *Transition[T]) {
+	for _, leaf := range sm.leaves {
+		for s := leaf; s != nil; s = s.parent {
+			for i := range s.automatic {
+				if s.automatic[i].isPermitted(ctx, input, &sm.site) == nil {
+					return leaf, &s.automatic[i]
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// completionTransition returns the first permitted transition registered for
+// TriggerDone on a superstate completed by the active leaf states, along with
+// the final leaf state to take it from.
+func (sm *StateMachine[T]) completionTransition(ctx context.Context, input T) (*State[T], *Transition[T]) {
+	for _, leaf := range sm.leaves {
+		if !leaf.final || leaf.parent == nil {
+			continue
+		}
+		super := leaf.parent
+		if super.isRegion() {
+			super = super.parent
+		}
+		if !sm.completed(super) {
+			continue
+		}
+		for i := range super.transitions {
+			tr := &super.transitions[i]
+			if tr.Trigger == TriggerDone && tr.isPermitted(ctx, input, &sm.site) == nil {
+				return leaf, tr
+			}
+		}
+	}
+	return nil, nil
+}
+
+// completed returns true if the superstate s rests in a final substate or, if s has
+// orthogonal regions, if every region rests in a final substate.
+func (sm *StateMachine[T]) completed(s *State[T]) bool {
+	if len(s.regions) == 0 {
+		return sm.restsInFinal(s)
+	}
+	for _, region := range s.regions {
+		if !sm.restsInFinal(region) {
+			return false
+		}
+	}
+	return true
+}
+
+// restsInFinal returns true if an active leaf state is a final direct substate of s.
+func (sm *StateMachine[T]) restsInFinal(s *State[T]) bool {
+	for _, leaf := range sm.leaves {
+		if leaf.final && leaf.parent == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Done returns true if the state machine rests in a final state which is not a
+// substate. See [State.SetFinal].
+func (sm *StateMachine[T]) Done() bool {
+	return sm.actual.final && sm.actual.parent == nil
+}
+
+// handle handles trigger t which has no transition from the current state.
+func (sm *StateMachine[T]) handle(ctx context.Context, t Trigger, input T, h handling) error {
+	switch h {
+	case handleIgnore:
+		return nil
+	case handleDefer:
+		if sm.dryRun {
+			return nil
+		}
+		sm.deferred = append(sm.deferred, queuedTrigger[T]{ctx: ctx, t: t, input: input})
+		return nil
+	}
+	return sm.unhandled(t)
+}
+
+// releaseDeferred moves deferred triggers to the queue ahead of triggers queued
+// during the ongoing transition so that they are fired in the order originally fired.
+func (sm *StateMachine[T]) releaseDeferred() {
+	if len(sm.deferred) == 0 {
+		return
+	}
+	pending := append(sm.deferred, sm.queue[sm.next:]...)
+	sm.queue = append(sm.queue[:sm.next], pending...)
+	sm.deferred = nil
+}
+
+// fireRegions dispatches trigger t to every active orthogonal region that
+// handles it, in order. If a region takes a transition that exits other
+// regions the remaining regions are not dispatched to. The errors of regions
+// that took no transition are returned only if no region took one, since the
+// state machine is otherwise not left unchanged.
+func (sm *StateMachine[T]) fireRegions(ctx context.Context, t Trigger, input T) error {
+	type candidate struct {
+		leaf *State[T]
+		tr   *Transition[T]
+	}
+	var candidates []candidate
+	h := handleNone
+	for _, leaf := range sm.leaves {
+		transition, leafHandling := leaf.resolve(t)
+		if transition == nil {
+			if leafHandling > h {
+				h = leafHandling // Deferring takes precedence over ignoring.
+			}
+			continue
+		}
+		duplicate := false
+		for _, c := range candidates {
+			// Transitions of superstates shared by several regions are taken once.
+			duplicate = duplicate || c.tr == transition
+		}
+		if !duplicate {
+			candidates = append(candidates, candidate{leaf: leaf, tr: transition})
+		}
+	}
+	if len(candidates) == 0 {
+		return sm.handle(ctx, t, input, h)
+	}
+	var errs []error
+	taken := false
+	for _, c := range candidates {
+		exitedRegions, err := sm.fireTransition(ctx, c.leaf, c.tr, input)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		taken = true
+		if exitedRegions {
+			break
+		}
+	}
+	if taken {
+		return nil
+	}
+	return joinErrors(errs)
+}
+
+// exitsOtherLeaves returns true if a transition from the active leaf to dst
+// would exit any other active leaf.
+func (sm *StateMachine[T]) exitsOtherLeaves(leaf, dst *State[T]) bool {
+	domain := transitionDomain(leaf, dst)
+	for _, other := range sm.leaves {
+		if !statesEqual(other, leaf) && sm.exits(other, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *StateMachine[T]) unhandled(t Trigger) error {
+	if sm.dryRun {
+		return &UnhandledTriggerError{State: sm.actual.label, Trigger: t}
+	}
+	if sm.onUnhandledTrigger != nil {
+		sm.site = callSite{phase: PhaseUnhandled}
+		return sm.onUnhandledTrigger(sm.actual, t)
+	}
+	if sm.panicOnUnhandled {
 		panic("trigger " + t.Quote() + " not handled for state " + sm.actual.String())
 	}
-	tr := *transition
-	if sm.onTransitioning.cb != nil {
-		sm.onTransitioning.cb(ctx, tr, input)
+	return &UnhandledTriggerError{State: sm.actual.label, Trigger: t}
+}
+
+// fireTransition fires transition from the active leaf state. It returns true
+// if the transition exited active leaves other than leaf.
+func (sm *StateMachine[T]) fireTransition(ctx context.Context, leaf *State[T], transition *Transition[T], input T) (exitedOthers bool, err error) {
+	guarded := transition.HasGuards()
+	if guarded && transition.hasAlternatives() {
+		// Guard clauses are evaluated to select the transition.
+		transition, err = transition.selectTransition(ctx, input, sm.rejectAmbiguous, &sm.site)
+		if err != nil {
+			return false, err
+		}
+		guarded = false
 	}
-	err := sm.fire(ctx, tr, input)
+	return sm.takeTransition(ctx, leaf, *transition, guarded, input)
+}
+
+// takeTransition takes transition tr from the active leaf state, checking its
+// guard clauses first if guarded is set. It returns true if the transition
+// exited active leaves other than leaf.
+func (sm *StateMachine[T]) takeTransition(ctx context.Context, leaf *State[T], tr Transition[T], guarded bool, input T) (exitedOthers bool, err error) {
+	if guarded {
+		// Guard clauses of the transition precede its destination selector and choice branches.
+		if err = tr.isPermitted(ctx, input, &sm.site); err != nil {
+			return false, err
+		}
+	}
+	tr, err = sm.resolveDst(ctx, leaf, tr, input)
 	if err != nil {
-		// an error here usually means a guard clause did not validate.
-		// or context.Context was cancelled (ctx.Err() != nil)
-		return err
+		return false, err
+	}
+	return sm.takeResolved(ctx, leaf, tr, input)
+}
+
+// resolveDst returns transition tr taken from the active leaf state with its
+// destination selected by its destination selector and choice branches.
+func (sm *StateMachine[T]) resolveDst(ctx context.Context, leaf *State[T], tr Transition[T], input T) (_ Transition[T], err error) {
+	tr.Src = leaf // Transition may be inherited from a superstate.
+	if tr.internal {
+		tr.Dst = leaf
+	}
+	if tr.IsDynamic() {
+		sm.site = callSite{phase: PhaseGuard, label: tr.selector.label}
+		tr.Dst, err = tr.selector.selectDst(ctx, input)
+		if err != nil {
+			return tr, err
+		}
+	}
+	var visited []*State[T]
+	for tr.Dst.choice {
+		if containsState(visited, tr.Dst) {
+			return tr, errors.New("choice \"" + tr.Dst.label + "\" branched back to itself")
+		}
+		visited = append(visited, tr.Dst)
+		tr.Dst, err = tr.Dst.selectBranch(ctx, input, &sm.site)
+		if err != nil {
+			return tr, err
+		}
+	}
+	if tr.Dst.resumes != HistoryNone {
+		// Transitions targeting a history pseudo-state resume its superstate.
+		tr.resume, tr.Dst = tr.Dst.resumes, tr.Dst.parent
 	}
-	sm.actual = transition.Dst
+	return tr, nil
+}
+
+// takeResolved takes the permitted transition tr returned by resolveDst. See takeTransition.
+func (sm *StateMachine[T]) takeResolved(ctx context.Context, leaf *State[T], tr Transition[T], input T) (exitedOthers bool, err error) {
+	if len(sm.leaves) > 1 {
+		exitedOthers = sm.exitsOtherLeaves(leaf, tr.Dst)
+	}
+	if sm.onTransitioning.cb != nil {
+		sm.runHook(ctx, tr, PhaseTransitioning, sm.onTransitioning, input)
+	}
+	if err = sm.fire(ctx, tr, input); err != nil {
+		// A callback failed or context.Context was cancelled (ctx.Err() != nil).
+		sm.journal.reset()
+		return false, err
+	}
+	// The transition may still be rolled back if a panic is recovered.
 	if sm.onTransitioned.cb != nil {
-		sm.onTransitioned.cb(ctx, tr, input)
+		sm.runHook(ctx, tr, PhaseTransitioned, sm.onTransitioned, input)
+	}
+	if !tr.internal && sm.onDone.cb != nil && sm.Done() {
+		sm.runHook(ctx, tr, PhaseTransitioned, sm.onDone, input)
+	}
+	if sm.result != nil {
+		sm.result.Transitions = append(sm.result.Transitions, tr)
+		sm.result.Exited = append(sm.result.Exited, sm.journal.exited...)
+		sm.result.Entered = append(sm.result.Entered, sm.journal.entered...)
+	}
+	if sm.dryRun {
+		sm.rollback(ctx, input)
+	}
+	sm.commit()
+	if !tr.internal {
+		sm.changed = true
+	}
+	return exitedOthers, nil
+}
+
+// unwindPanic restores the state of sm to that before the transition in progress,
+// if any, when a panic propagates out of it so that sm remains usable once the
+// panic is recovered by the caller. Compensations are not run.
+func (sm *StateMachine[T]) unwindPanic(ctx context.Context) {
+	if !sm.journal.active {
+		return // Not panicking or no transition in progress.
+	}
+	sm.restoreJournal(ctx)
+	sm.journal.reset()
+}
+
+// recoverPanic recovers a panic raised by a guard clause or callback while firing
+// trigger t and sets err to a PanicError. The transition in progress, if any, is
+// rolled back. Under the PanicFault policy the fault state is then entered.
+// A panic raised while entering the fault state rolls back the transition into
+// it and propagates.
+func (sm *StateMachine[T]) recoverPanic(ctx context.Context, t Trigger, input T, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	*err = &PanicError{Label: sm.site.label, Phase: sm.site.phase, Trigger: t, Value: v, Stack: debug.Stack()}
+	if sm.journal.active {
+		sm.rollback(ctx, input)
+	}
+	sm.journal.reset()
+	if sm.panicPolicy != PanicFault || sm.fault.Contains(sm.actual) {
+		return
+	}
+	leaf := sm.leaves[0]
+	fault := Transition[T]{Src: leaf, Dst: sm.fault, Trigger: TriggerFault}
+	defer sm.unwindPanic(ctx) // Panics entering fault propagate once it is rolled back.
+	if _, faultErr := sm.takeTransition(ctx, leaf, fault, false, input); faultErr != nil {
+		*err = joinErrors([]error{*err, faultErr})
 	}
-	return nil
 }
 
 // TriggersPermitted returns triggers which are permitted for
 // the current State given input and ctx Context by calling the guard clauses with input.
 // A Trigger transition is permitted if all guard clauses return true.
+// Transitions inherited from superstates and those of all active orthogonal
+// regions are included. See [StateMachine.ExplainTriggers] to find out why a
+// trigger is not permitted.
 func (sm *StateMachine[T]) TriggersPermitted(ctx context.Context, input T) []Trigger {
 	var permitted []Trigger
-	for _, transition := range sm.actual.transitions {
-		if err := transition.isPermitted(ctx, input); err == nil {
-			permitted = append(permitted, transition.Trigger)
-		}
+	for _, leaf := range sm.leaves {
+		leaf.forEachTransition(func(tr *Transition[T]) error {
+			if tr.Trigger == TriggerDone {
+				return nil // Not fireable.
+			}
+			if err := tr.isPermitted(ctx, input, nil); err == nil {
+				permitted = appendTrigger(permitted, tr.Trigger)
+			}
+			return nil
+		})
 	}
 	return permitted
 }
 
-// TriggersAvailable returns all triggers registered for the current State.
+// ExplainTriggers evaluates every guard clause of every transition available from
+// the current State given input and ctx Context and returns a map with an entry for
+// each trigger available. The entry is nil if the trigger is permitted. Otherwise it
+// contains the GuardClauseError of every guard clause that failed, joined, across all
+// transitions registered for the trigger. Unlike when firing a trigger, guard clauses
+// are evaluated even after one fails. Transitions inherited from superstates and those
+// of all active orthogonal regions are included.
+func (sm *StateMachine[T]) ExplainTriggers(ctx context.Context, input T) map[Trigger]error {
+	blocked := make(map[Trigger][]error)
+	permitted := make(map[Trigger]bool)
+	evaluated := make(map[*Transition[T]]bool)
+	for _, leaf := range sm.leaves {
+		leaf.forEachTransition(func(tr *Transition[T]) error {
+			if tr.Trigger == TriggerDone || permitted[tr.Trigger] || evaluated[tr] {
+				return nil
+			}
+			evaluated[tr] = true // Transitions of superstates shared by several regions.
+			errs := tr.guardErrors(ctx, input)
+			if len(errs) == 0 {
+				permitted[tr.Trigger] = true
+				delete(blocked, tr.Trigger)
+			} else {
+				blocked[tr.Trigger] = append(blocked[tr.Trigger], errs...)
+			}
+			return nil
+		})
+	}
+	explained := make(map[Trigger]error, len(permitted)+len(blocked))
+	for t := range permitted {
+		explained[t] = nil
+	}
+	for t, errs := range blocked {
+		explained[t] = joinErrors(errs)
+	}
+	return explained
+}
+
+// TriggersAvailable returns all triggers registered for the current State,
+// including those inherited from superstates and those of all active orthogonal regions.
 // Firing any of these triggers may fail if a guard clause returns false.
 func (sm *StateMachine[T]) TriggersAvailable() []Trigger {
 	var available []Trigger
-	for _, transition := range sm.actual.transitions {
-		available = append(available, transition.Trigger)
+	for _, leaf := range sm.leaves {
+		leaf.forEachTransition(func(tr *Transition[T]) error {
+			if tr.Trigger == TriggerDone {
+				return nil // Not fireable.
+			}
+			available = appendTrigger(available, tr.Trigger)
+			return nil
+		})
 	}
 	return available
 }
 
+// TriggersIgnored returns the triggers ignored by the current State, including
+// those ignored by superstates and by all active orthogonal regions. Firing any
+// of these triggers has no effect. See [State.Ignore].
+func (sm *StateMachine[T]) TriggersIgnored() []Trigger {
+	var ignored []Trigger
+	for _, leaf := range sm.leaves {
+		for s := leaf; s != nil; s = s.parent {
+			for _, t := range s.ignored {
+				if _, h := leaf.resolve(t); h == handleIgnore {
+					ignored = appendTrigger(ignored, t)
+				}
+			}
+		}
+	}
+	return ignored
+}
+
+// Validate checks the states reachable from the start and current state of the
+// state machine for misconfigurations and returns an error describing each found:
+//   - A choice with no branches.
+//   - A choice with no else branch, which aborts transitions when no branch is permitted.
+//   - A choice which may branch back to itself through other choices.
+func (sm *StateMachine[T]) Validate() error {
+	var errs []error
+	seen := make(map[string]struct{})
+	check := func(s *State[T]) error {
+		if _, ok := seen[s.label]; ok {
+			return nil
+		}
+		seen[s.label] = struct{}{}
+		switch {
+		case !s.choice:
+		case len(s.branches) == 0:
+			errs = append(errs, errors.New("choice \""+s.label+"\" has no branches"))
+		case !s.hasElse():
+			errs = append(errs, errors.New("choice \""+s.label+"\" has no else branch"))
+		}
+		if s.choice && branchesTo(s, s, nil) {
+			errs = append(errs, errors.New("choice \""+s.label+"\" may branch back to itself"))
+		}
+		return nil
+	}
+	WalkStates(sm.start, check)
+	WalkStates(sm.actual, check)
+	return joinErrors(errs)
+}
+
+// branchesTo returns true if choice s or a choice reached through its branches
+// has a branch to dst. visited contains the choices already followed.
+func branchesTo[T input](s, dst *State[T], visited []*State[T]) bool {
+	for _, branch := range s.branches {
+		next := branch.Dst
+		switch {
+		case statesEqual(next, dst):
+			return true
+		case !next.choice || containsState(visited, next):
+		case branchesTo(next, dst, append(visited, next)):
+			return true
+		}
+	}
+	return false
+}
+
+// Deferred returns the triggers in the deferred queue in the order they were fired.
+// See [State.Defer].
+func (sm *StateMachine[T]) Deferred() []Trigger {
+	deferred := make([]Trigger, len(sm.deferred))
+	for i := range sm.deferred {
+		deferred[i] = sm.deferred[i].t
+	}
+	return deferred
+}
+
+// PurgeDeferred discards all triggers in the deferred queue and returns how many were discarded.
+func (sm *StateMachine[T]) PurgeDeferred() int {
+	n := len(sm.deferred)
+	sm.deferred = nil
+	return n
+}
+
+// appendTrigger appends t to triggers if not already present.
+func appendTrigger(triggers []Trigger, t Trigger) []Trigger {
+	for _, existing := range triggers {
+		if existing == t {
+			return triggers
+		}
+	}
+	return append(triggers, t)
+}
+
 // OnUnhandledTrigger registeres the callback for when a trigger with no
 // transition is encountered for the StateMachine's current state.
 // It replaces the callback set by a previous call to OnUnhandledTrigger.
@@ -116,8 +1189,63 @@ func (sm *StateMachine[T]) OnUnhandledTrigger(f func(current *State[T], t Trigge
 	sm.onUnhandledTrigger = f
 }
 
+// PanicOnUnhandledTrigger sets whether Fire panics when a trigger with no transition
+// is encountered for the current state and no OnUnhandledTrigger callback is set.
+// By default Fire returns an UnhandledTriggerError. Panicking is useful during
+// development to catch missing transitions early.
+func (sm *StateMachine[T]) PanicOnUnhandledTrigger(enable bool) {
+	sm.panicOnUnhandled = enable
+}
+
+// PanicPolicy specifies how a state machine handles panics raised by guard clauses
+// and callbacks while firing a trigger. See [StateMachine.SetPanicPolicy].
+type PanicPolicy uint8
+
+const (
+	// PanicPropagate is the default policy. Panics unwind through Fire.
+	PanicPropagate PanicPolicy = iota
+	// PanicRollback recovers panics and rolls back the transition in progress as
+	// if the panicking callback had returned an error.
+	PanicRollback
+	// PanicFault recovers panics and rolls back the transition in progress like
+	// PanicRollback. The state machine then transitions into its fault state.
+	PanicFault
+)
+
+// SetPanicPolicy sets how Fire handles panics raised by guard clauses, destination
+// selectors, fringe callbacks and the OnTransitioning, OnTransitioned, OnDone and
+// OnUnhandledTrigger callbacks. Panics raised by PanicOnUnhandledTrigger are
+// recovered as well. When a panic is recovered Fire returns a PanicError recording
+// where it occurred. Triggers queued from within callbacks are still processed.
+//
+// Under the PanicFault policy the state machine then takes a transition with
+// TriggerFault from its current state into fault, running exit and entry callbacks
+// as usual. Panics raised during the transition into fault are not recovered and
+// propagate once the transition into fault is rolled back.
+// fault is ignored by other policies. SetPanicPolicy panics if policy is PanicFault
+// and fault is nil or a choice.
+func (sm *StateMachine[T]) SetPanicPolicy(policy PanicPolicy, fault *State[T]) {
+	if policy > PanicFault {
+		panic("invalid panic policy")
+	}
+	if policy == PanicFault && (fault == nil || fault.choice) {
+		panic("panic policy requires a fault state")
+	}
+	sm.panicPolicy = policy
+	sm.fault = fault
+}
+
+// RejectAmbiguousTransitions sets whether Fire evaluates all transitions registered
+// for a trigger on a state and returns an AmbiguousTransitionError if more than one
+// is permitted. A fallback transition with no guard clauses is not considered ambiguous
+// with a guarded transition. By default the first transition permitted is taken.
+func (sm *StateMachine[T]) RejectAmbiguousTransitions(enable bool) {
+	sm.rejectAmbiguous = enable
+}
+
 // InspectFringes registers the callback which is invoked on on each individual fringe callback
-// encountered during a transition. This is almost exclusively useful for logging and debugging.
+// encountered during a transition, transition effects included. This is almost exclusively
+// useful for logging and debugging.
 // The callback argument is invoked before the FringeCallback is invoked.
 func (sm *StateMachine[T]) InspectFringes(cb func(tr Transition[T], fcb FringeCallback[T], input T)) {
 	sm.onFringe = cb
@@ -125,8 +1253,10 @@ func (sm *StateMachine[T]) InspectFringes(cb func(tr Transition[T], fcb FringeCa
 
 // OnTransitioning registers the callback which is invoked when transitioning commences.
 // It replaces the callback set by a previous call to OnTransitioning.
-// It is the first callback executed when transitioning, preceding any guard clauses,
-// exiting and entering callbacks.
+// It is invoked once the guard clauses of the transition, its destination selector
+// and the branches of choices it ends in have been evaluated, in that order, and is
+// the first callback executed when transitioning, preceding exiting and entering callbacks.
+// The callback is therefore not invoked for transitions that are not permitted.
 func (sm *StateMachine[T]) OnTransitioning(fcb FringeCallback[T]) {
 	sm.onTransitioning = fcb
 }
@@ -140,6 +1270,13 @@ func (sm *StateMachine[T]) OnTransitioned(fcb FringeCallback[T]) {
 	sm.onTransitioned = fcb
 }
 
+// OnDone registers the callback which is invoked when the state machine reaches a
+// final state which is not a substate, after the OnTransitioned callback.
+// It replaces the callback set by a previous call to OnDone. See [StateMachine.Done].
+func (sm *StateMachine[T]) OnDone(fcb FringeCallback[T]) {
+	sm.onDone = fcb
+}
+
 // AlwaysPermit registers a trigger which is always permitted for the current state.
 // Triggers set on a state take precedence over an always permitted trigger.
 // It panics if trigger is the wildcard trigger or if dst is nil.
@@ -156,7 +1293,7 @@ func (sm *StateMachine[T]) AlwaysPermit(trigger Trigger, dst *State[T], guards .
 	// To maintain consistency of our state machine we add the always permitted
 	// transition to all states in our tree without the transition.
 	WalkStates(sm.actual, func(s *State[T]) (err error) {
-		if !s.hasTransition(trigger) {
+		if tr, h := s.resolve(trigger); tr == nil && h == handleNone && !s.choice && !s.final {
 			transitionWithSrc := transition
 			transitionWithSrc.Src = s
 			s.transitions = append(s.transitions, transitionWithSrc)
@@ -164,7 +1301,7 @@ func (sm *StateMachine[T]) AlwaysPermit(trigger Trigger, dst *State[T], guards .
 		return nil
 	})
 	// add the transition to the destination state if it does not already have it.
-	if !dst.hasTransition(trigger) {
+	if tr, h := dst.resolve(trigger); tr == nil && h == handleNone {
 		transition.Src = dst
 		dst.transitions = append(dst.transitions, transition)
 	}
@@ -177,19 +1314,27 @@ func (sm *StateMachine[T]) StateIsSource() bool {
 	currentState := sm.State()
 	isSource := true
 	WalkStates(currentState, func(s *State[T]) error {
-		for _, tr := range s.transitions {
-			if statesEqual(currentState, tr.Dst) {
-				isSource = false
-				return errTriggerWildcardNotAllowed // Break out of WalkStates.
+		return s.forEachTransition(func(tr *Transition[T]) error {
+			for _, dst := range tr.destinations() {
+				if statesEqual(currentState, dst) {
+					isSource = false
+					return errBreak // Break out of WalkStates.
+				}
 			}
-		}
-		return nil
+			return nil
+		})
 	})
 	return isSource
 }
 
 // StateIsSink returns true if the current state is a sink state, that is to say
-// it has no transitions to states other than itself.
+// it has no transitions to states other than itself. Within orthogonal regions
+// the active state of every region must be a sink.
 func (sm *StateMachine[T]) StateIsSink() bool {
-	return sm.State().isSink()
+	for _, leaf := range sm.leaves {
+		if !leaf.isSink() {
+			return false
+		}
+	}
+	return true
 }
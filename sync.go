@@ -0,0 +1,215 @@
+package maquina
+
+import (
+	"context"
+	"sync"
+)
+
+// SyncStateMachine is a concurrency safe wrapper around a StateMachine.
+// Calls to Fire are serialized so that a transition always runs to completion
+// before the next one begins, preserving the callback ordering of StateMachine.
+// Methods that only query the machine may run concurrently with each other
+// and only wait on an ongoing transition to finish.
+//
+// Callbacks registered on states and on the wrapped StateMachine are invoked
+// with the lock held and therefore must not call methods on the SyncStateMachine.
+// Callbacks may instead fire triggers on the wrapped StateMachine, which are
+// queued and processed before the lock is released.
+// Activities may call methods on the SyncStateMachine since they run in their
+// own goroutine and are waited for after the lock is released. See [State.Do].
+type SyncStateMachine[T input] struct {
+	mu sync.RWMutex
+	sm *StateMachine[T]
+}
+
+// NewSyncStateMachine returns a SyncStateMachine that wraps sm. The caller
+// should finish configuring sm before wrapping it and should not use sm
+// directly afterwards, lest data races occur. Triggers fired by timers and
+// activities of sm are fired with the lock held. See [StateMachine.DispatchAsync].
+func NewSyncStateMachine[T input](sm *StateMachine[T]) *SyncStateMachine[T] {
+	if sm == nil {
+		panic("nil state machine")
+	}
+	ssm := &SyncStateMachine[T]{sm: sm}
+	sm.waitStopped = true
+	sm.DispatchAsync(func(fire func()) {
+		ssm.mu.Lock()
+		defer ssm.unlock()
+		fire()
+	})
+	return ssm
+}
+
+// unlock releases the write lock and then waits for the activities stopped while
+// it was held to return.
+func (ssm *SyncStateMachine[T]) unlock() {
+	stopped := ssm.sm.stopped
+	ssm.sm.stopped = nil
+	ssm.mu.Unlock()
+	for _, done := range stopped {
+		<-done
+	}
+}
+
+// Fire fires the state transition corresponding to the trigger t. It blocks
+// until any ongoing transition has completed. See [StateMachine.Fire].
+func (ssm *SyncStateMachine[T]) Fire(ctx context.Context, t Trigger, input T) error {
+	ssm.mu.Lock()
+	defer ssm.unlock()
+	return ssm.sm.Fire(ctx, t, input)
+}
+
+// FireWithResult fires the state transition corresponding to the trigger t and
+// returns a FireResult describing what it did. It blocks until any ongoing
+// transition has completed. See [StateMachine.FireWithResult].
+func (ssm *SyncStateMachine[T]) FireWithResult(ctx context.Context, t Trigger, input T) (FireResult[T], error) {
+	ssm.mu.Lock()
+	defer ssm.unlock()
+	return ssm.sm.FireWithResult(ctx, t, input)
+}
+
+// Plan returns the FireResult that firing trigger t with input would produce
+// without running any callbacks nor changing the state. See [StateMachine.Plan].
+func (ssm *SyncStateMachine[T]) Plan(ctx context.Context, t Trigger, input T) (FireResult[T], error) {
+	ssm.mu.Lock() // Planning temporarily modifies the state machine.
+	defer ssm.unlock()
+	return ssm.sm.Plan(ctx, t, input)
+}
+
+// FireBg fires the state transition corresponding to the trigger t with
+// context.Background(). See [StateMachine.FireBg].
+func (ssm *SyncStateMachine[T]) FireBg(t Trigger, input T) error {
+	return ssm.Fire(context.Background(), t, input)
+}
+
+// State returns the current state.
+func (ssm *SyncStateMachine[T]) State() *State[T] {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.State()
+}
+
+// StateLabel returns the current state label. See [StateMachine.StateLabel].
+func (ssm *SyncStateMachine[T]) StateLabel() string { return ssm.State().Label() }
+
+// Configuration returns the active leaf state of each orthogonal region the state
+// machine is in, or the current state. See [StateMachine.Configuration].
+func (ssm *SyncStateMachine[T]) Configuration() []*State[T] {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.Configuration()
+}
+
+// History returns the substate recorded when the superstate s was last exited.
+// See [StateMachine.History].
+func (ssm *SyncStateMachine[T]) History(s *State[T]) *State[T] {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.History(s)
+}
+
+// HistoryConfiguration returns the substates recorded when the superstate s was
+// last exited. See [StateMachine.HistoryConfiguration].
+func (ssm *SyncStateMachine[T]) HistoryConfiguration(s *State[T]) []*State[T] {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.HistoryConfiguration(s)
+}
+
+// Snapshot returns a snapshot of the current state and recorded history.
+// See [StateMachine.Snapshot].
+func (ssm *SyncStateMachine[T]) Snapshot() Snapshot {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.Snapshot()
+}
+
+// Restore sets the current state and recorded history to those of snap. It blocks
+// until any ongoing transition has completed. See [StateMachine.Restore].
+func (ssm *SyncStateMachine[T]) Restore(snap Snapshot) error {
+	ssm.mu.Lock()
+	defer ssm.unlock()
+	return ssm.sm.Restore(snap)
+}
+
+// Done reports whether the state machine rests in a final state.
+// See [StateMachine.Done].
+func (ssm *SyncStateMachine[T]) Done() bool {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.Done()
+}
+
+// StateContext returns the context of the active state s which is cancelled once
+// s is exited. See [StateMachine.StateContext].
+func (ssm *SyncStateMachine[T]) StateContext(s *State[T]) context.Context {
+	ssm.mu.Lock()
+	defer ssm.unlock()
+	return ssm.sm.StateContext(s)
+}
+
+// TriggersPermitted returns triggers which are permitted for the current State
+// given input and ctx Context. Guard clauses may be called concurrently by
+// simultaneous calls to TriggersPermitted. See [StateMachine.TriggersPermitted].
+func (ssm *SyncStateMachine[T]) TriggersPermitted(ctx context.Context, input T) []Trigger {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.TriggersPermitted(ctx, input)
+}
+
+// ExplainTriggers returns for each trigger available for the current State the
+// errors of all guard clauses that fail given input and ctx Context, or nil if the
+// trigger is permitted. Guard clauses may be called concurrently by simultaneous
+// calls to ExplainTriggers. See [StateMachine.ExplainTriggers].
+func (ssm *SyncStateMachine[T]) ExplainTriggers(ctx context.Context, input T) map[Trigger]error {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.ExplainTriggers(ctx, input)
+}
+
+// TriggersAvailable returns all triggers registered for the current State.
+// See [StateMachine.TriggersAvailable].
+func (ssm *SyncStateMachine[T]) TriggersAvailable() []Trigger {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.TriggersAvailable()
+}
+
+// TriggersIgnored returns the triggers ignored by the current State.
+// See [StateMachine.TriggersIgnored].
+func (ssm *SyncStateMachine[T]) TriggersIgnored() []Trigger {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.TriggersIgnored()
+}
+
+// Deferred returns the triggers in the deferred queue. See [StateMachine.Deferred].
+func (ssm *SyncStateMachine[T]) Deferred() []Trigger {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.Deferred()
+}
+
+// PurgeDeferred discards all triggers in the deferred queue.
+// See [StateMachine.PurgeDeferred].
+func (ssm *SyncStateMachine[T]) PurgeDeferred() int {
+	ssm.mu.Lock()
+	defer ssm.unlock()
+	return ssm.sm.PurgeDeferred()
+}
+
+// StateIsSource reports whether the current state is a source state.
+// See [StateMachine.StateIsSource].
+func (ssm *SyncStateMachine[T]) StateIsSource() bool {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.StateIsSource()
+}
+
+// StateIsSink reports whether the current state is a sink state.
+// See [StateMachine.StateIsSink].
+func (ssm *SyncStateMachine[T]) StateIsSink() bool {
+	ssm.mu.RLock()
+	defer ssm.mu.RUnlock()
+	return ssm.sm.StateIsSink()
+}
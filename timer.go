@@ -0,0 +1,133 @@
+package maquina
+
+import (
+	"context"
+	"time"
+)
+
+// Clock starts the timers of states declared with [State.After]. It allows
+// replacing real time with a fake clock in tests. See [StateMachine.SetClock].
+type Clock interface {
+	// AfterFunc calls f in its own goroutine once duration d has elapsed
+	// and returns a Timer that can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by a Clock. *time.Timer implements Timer.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// realClock is the Clock used by default. It is backed by time.AfterFunc.
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// stateTimer is a timer declaration of a state.
+type stateTimer struct {
+	d time.Duration
+	t Trigger
+}
+
+// activeTimer is a timer started on entering state.
+type activeTimer[T input] struct {
+	id    uint64
+	state *State[T]
+	timer Timer
+}
+
+// After declares a timer on receiver s which fires Trigger t once duration d has
+// elapsed since s was entered, with the input of the transition that entered s.
+// The timer is started each time s is entered and stopped when s is exited, so
+// the trigger is fired only if the state machine remains within s for d.
+// A state machine cannot be created in a state with timers, nor within a
+// superstate with timers, since they would never be started. See [NewStateMachine].
+//
+// Timers fire from their own goroutine. A state machine with timers should
+// therefore be wrapped in a SyncStateMachine, or be given a dispatch hook with
+// [StateMachine.DispatchAsync], to prevent data races. Errors returned when
+// firing timer triggers are discarded.
+func (s *State[T]) After(d time.Duration, t Trigger) {
+	t.mustNotBeReserved()
+	if d <= 0 {
+		panic("timer duration must be positive")
+	}
+	s.timers = append(s.timers, stateTimer{d: d, t: t})
+}
+
+// timerDuration returns the duration of the timer declared for trigger t on s
+// or, if s has none, on its closest ancestor.
+func (s *State[T]) timerDuration(t Trigger) (time.Duration, bool) {
+	for ; s != nil; s = s.parent {
+		for _, st := range s.timers {
+			if st.t == t {
+				return st.d, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// SetClock sets the clock used to start the timers of states entered.
+// By default real time is used. See [State.After].
+func (sm *StateMachine[T]) SetClock(c Clock) {
+	sm.clock = c
+}
+
+// startTimers starts the timers declared on s.
+func (sm *StateMachine[T]) startTimers(s *State[T], input T) {
+	clock := sm.clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	for _, st := range s.timers {
+		sm.timerSeq++
+		id, t := sm.timerSeq, st.t
+		timer := clock.AfterFunc(st.d, func() {
+			sm.runAsync(func() { sm.timerExpired(id, t, input) })
+		})
+		sm.timers = append(sm.timers, activeTimer[T]{id: id, state: s, timer: timer})
+	}
+}
+
+// stopTimers stops the active timers started on entering s.
+func (sm *StateMachine[T]) stopTimers(s *State[T]) {
+	kept := sm.timers[:0]
+	for _, at := range sm.timers {
+		if statesEqual(at.state, s) {
+			at.timer.Stop()
+		} else {
+			kept = append(kept, at)
+		}
+	}
+	sm.timers = kept
+}
+
+// suspendTimers moves the active timers started on entering the exited state s
+// to the journal. They are stopped once the transition completes or restored
+// with their remaining duration if it is rolled back.
+func (sm *StateMachine[T]) suspendTimers(s *State[T]) {
+	kept := sm.timers[:0]
+	for _, at := range sm.timers {
+		if statesEqual(at.state, s) {
+			sm.journal.timers = append(sm.journal.timers, at)
+		} else {
+			kept = append(kept, at)
+		}
+	}
+	sm.timers = kept
+}
+
+// timerExpired fires trigger t if the timer with the given id is still active.
+// Timers stopped after expiring and before being dispatched are not active.
+func (sm *StateMachine[T]) timerExpired(id uint64, t Trigger, input T) {
+	for i, at := range sm.timers {
+		if at.id == id {
+			sm.timers = append(sm.timers[:i], sm.timers[i+1:]...)
+			sm.Fire(context.Background(), t, input)
+			return
+		}
+	}
+}